@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package agentcfgtest provides utilities for testing agentcfg.Fetcher
+// implementations and their users: a conformance suite, see Suite, and an
+// in-memory fetcher, see Fetcher.
+package agentcfgtest // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg/agentcfgtest"
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+)
+
+// Fetcher is an in-memory agentcfg.Fetcher, matching queries against its
+// agent configs with agentcfg.MatchAgentConfig. It records the queries it
+// receives. The zero value serves no agent configs.
+type Fetcher struct {
+	err     error
+	cfgs    []agentcfg.AgentConfig
+	queries []agentcfg.Query
+	mu      sync.Mutex
+}
+
+var _ agentcfg.Fetcher = (*Fetcher)(nil)
+
+// NewFetcher returns a Fetcher serving cfgs.
+func NewFetcher(cfgs ...agentcfg.AgentConfig) *Fetcher {
+	return &Fetcher{cfgs: cfgs}
+}
+
+// Fetch records query and returns the agent config matching it, or the
+// error set with SetError.
+func (f *Fetcher) Fetch(_ context.Context, query agentcfg.Query) (agentcfg.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	if f.err != nil {
+		return agentcfg.Result{}, f.err
+	}
+	return agentcfg.MatchAgentConfig(query, f.cfgs), nil
+}
+
+// SetConfigs replaces the agent configs served by f.
+func (f *Fetcher) SetConfigs(cfgs ...agentcfg.AgentConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfgs = cfgs
+}
+
+// SetError makes Fetch return err, or agent configs again if err is nil.
+// For instance, agentcfg.ErrNotReady emulates a
+// fetcher whose cache is not initialized yet.
+func (f *Fetcher) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Queries returns the queries received by f, in order.
+func (f *Fetcher) Queries() []agentcfg.Query {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queries)
+}
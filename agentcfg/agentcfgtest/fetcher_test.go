@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfgtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+)
+
+func TestFetcherConformance(t *testing.T) {
+	Suite{
+		NewFetcher: func(_ *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher {
+			return NewFetcher(cfgs...)
+		},
+		NewNotReadyFetcher: func(*testing.T) agentcfg.Fetcher {
+			f := NewFetcher()
+			f.SetError(agentcfg.ErrNotReady)
+			return f
+		},
+	}.Run(t)
+}
+
+func TestFetcher(t *testing.T) {
+	var f Fetcher
+	query := agentcfg.Query{Service: agentcfg.Service{Name: "opbeans"}}
+	result, err := f.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, agentcfg.EtagSentinel, result.Source.Etag)
+
+	f.SetConfigs(agentcfg.AgentConfig{ServiceName: "opbeans", Etag: "abc"})
+	result, err = f.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", result.Source.Etag)
+
+	f.SetError(errors.New("boom"))
+	_, err = f.Fetch(context.Background(), query)
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, []agentcfg.Query{query, query, query}, f.Queries())
+}
@@ -0,0 +1,222 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfgtest // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg/agentcfgtest"
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+)
+
+// Suite is a conformance test suite for agentcfg.Fetcher implementations,
+// checking that they follow the agent config matching rules:
+//
+//   - service name and environment matches take precedence over service
+//     name matches, which take precedence over service environment
+//     matches, which take precedence over agent configs without service
+//   - at each of these levels, agent configs for the query agent name, or
+//     a prefix of it, take precedence over agent configs without agent name
+//   - queries without matching agent config get empty settings and the
+//     agentcfg.EtagSentinel etag
+//   - the settings of agent configs of insecure agents are restricted to
+//     agentcfg.UnrestrictedSettings
+//   - fetchers not ready to serve agent configs return
+//     agentcfg.ErrInfrastructureNotReady
+type Suite struct {
+	// NewFetcher returns a fetcher ready to serve cfgs.
+	NewFetcher func(t *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher
+	// NewNotReadyFetcher, if set, returns a fetcher not ready to serve
+	// agent configs yet, e.g. one whose cache is not initialized.
+	NewNotReadyFetcher func(t *testing.T) agentcfg.Fetcher
+	// ComputesEtags reports whether the fetcher computes the etags of the
+	// agent configs it serves, instead of serving AgentConfig.Etag. Etags
+	// are then only checked to be stable.
+	ComputesEtags bool
+	// IgnoresAgentNames reports whether the fetcher ignores the query agent
+	// name, as Kibana does. Queries with agent name are then not checked.
+	IgnoresAgentNames bool
+}
+
+// suiteConfigs are the agent configs served by the fetchers under test,
+// identified by their sample rate.
+var suiteConfigs = []agentcfg.AgentConfig{
+	{
+		ServiceName:        "opbeans",
+		ServiceEnvironment: "production",
+		Config:             map[string]string{agentcfg.TransactionSamplingRateKey: "0.1", "capture_body": "all"},
+		Etag:               "name_env",
+	},
+	{
+		ServiceName: "opbeans",
+		Config:      map[string]string{agentcfg.TransactionSamplingRateKey: "0.2"},
+		Etag:        "name",
+	},
+	{
+		ServiceEnvironment: "production",
+		Config:             map[string]string{agentcfg.TransactionSamplingRateKey: "0.3"},
+		Etag:               "env",
+	},
+	{
+		Config: map[string]string{agentcfg.TransactionSamplingRateKey: "0.4"},
+		Etag:   "default",
+	},
+	{
+		ServiceName: "frontend",
+		AgentName:   "rum-js",
+		Config:      map[string]string{agentcfg.TransactionSamplingRateKey: "0.5", "capture_body": "all"},
+		Etag:        "insecure",
+	},
+	{
+		ServiceName: "opbeans",
+		AgentName:   "opentelemetry/",
+		Config:      map[string]string{agentcfg.TransactionSamplingRateKey: "0.6"},
+		Etag:        "name_agent",
+	},
+}
+
+// Run runs the conformance suite.
+func (s Suite) Run(t *testing.T) {
+	t.Run("precedence", s.testPrecedence)
+	t.Run("empty", s.testEmpty)
+	if s.NewNotReadyFetcher != nil {
+		t.Run("not_ready", s.testNotReady)
+	}
+}
+
+func (s Suite) testPrecedence(t *testing.T) {
+	fetcher := s.NewFetcher(t, cloneConfigs(suiteConfigs))
+	for _, tc := range []struct {
+		expectedSettings agentcfg.Settings
+		name             string
+		expectedEtag     string
+		query            agentcfg.Query
+	}{{
+		name:             "name_env",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "opbeans", Environment: "production"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.1", "capture_body": "all"},
+		expectedEtag:     "name_env",
+	}, {
+		name:             "name",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "opbeans", Environment: "staging"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.2"},
+		expectedEtag:     "name",
+	}, {
+		name:             "name_without_env",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "opbeans"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.2"},
+		expectedEtag:     "name",
+	}, {
+		name:             "name_agent",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "opbeans", Environment: "staging"}, AgentName: "opentelemetry/java"},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.6"},
+		expectedEtag:     "name_agent",
+	}, {
+		name:             "name_env_agent",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "opbeans", Environment: "production"}, AgentName: "opentelemetry/java"},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.1", "capture_body": "all"},
+		expectedEtag:     "name_env",
+	}, {
+		name:             "env",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "other", Environment: "production"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.3"},
+		expectedEtag:     "env",
+	}, {
+		name:             "default",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "other", Environment: "staging"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.4"},
+		expectedEtag:     "default",
+	}, {
+		name:             "insecure_agent",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "frontend"}, InsecureAgents: []string{"rum-js"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.5"},
+		expectedEtag:     "insecure",
+	}, {
+		name:             "secure_agent",
+		query:            agentcfg.Query{Service: agentcfg.Service{Name: "frontend"}},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.5", "capture_body": "all"},
+		expectedEtag:     "insecure",
+	}, {
+		name: "insecure_agents_not_matching",
+		query: agentcfg.Query{
+			Service:        agentcfg.Service{Name: "opbeans", Environment: "production"},
+			InsecureAgents: []string{"rum-js"},
+		},
+		expectedSettings: agentcfg.Settings{agentcfg.TransactionSamplingRateKey: "0.1", "capture_body": "all"},
+		expectedEtag:     "name_env",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if s.IgnoresAgentNames && tc.query.AgentName != "" {
+				t.Skip("fetcher ignores agent names")
+			}
+			result, err := fetcher.Fetch(context.Background(), tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedSettings, result.Source.Settings)
+			if !s.ComputesEtags {
+				assert.Equal(t, tc.expectedEtag, result.Source.Etag)
+				return
+			}
+			assert.NotEmpty(t, result.Source.Etag)
+			assert.NotEqual(t, agentcfg.EtagSentinel, result.Source.Etag)
+			again, err := fetcher.Fetch(context.Background(), tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, result.Source.Etag, again.Source.Etag)
+		})
+	}
+}
+
+func (s Suite) testEmpty(t *testing.T) {
+	// Without default agent config, unknown services have no agent config.
+	fetcher := s.NewFetcher(t, cloneConfigs(suiteConfigs[:2]))
+	for _, query := range []agentcfg.Query{
+		{Service: agentcfg.Service{Name: "other", Environment: "production"}},
+		{Service: agentcfg.Service{Name: "other"}, Etag: "name"},
+		{Service: agentcfg.Service{Name: "other"}, InsecureAgents: []string{"rum-js"}},
+	} {
+		result, err := fetcher.Fetch(context.Background(), query)
+		require.NoError(t, err)
+		assert.Empty(t, result.Source.Settings)
+		assert.Equal(t, agentcfg.EtagSentinel, result.Source.Etag)
+	}
+
+	fetcher = s.NewFetcher(t, nil)
+	result, err := fetcher.Fetch(context.Background(), agentcfg.Query{Service: agentcfg.Service{Name: "opbeans"}})
+	require.NoError(t, err)
+	assert.Empty(t, result.Source.Settings)
+	assert.Equal(t, agentcfg.EtagSentinel, result.Source.Etag)
+}
+
+func (s Suite) testNotReady(t *testing.T) {
+	fetcher := s.NewNotReadyFetcher(t)
+	_, err := fetcher.Fetch(context.Background(), agentcfg.Query{Service: agentcfg.Service{Name: "opbeans"}})
+	assert.EqualError(t, err, agentcfg.ErrInfrastructureNotReady)
+}
+
+// cloneConfigs clones cfgs, so that fetchers may modify them.
+func cloneConfigs(cfgs []agentcfg.AgentConfig) []agentcfg.AgentConfig {
+	clones := make([]agentcfg.AgentConfig, len(cfgs))
+	for i, cfg := range cfgs {
+		clones[i] = cfg
+		clones[i].Config = maps.Clone(cfg.Config)
+	}
+	return clones
+}
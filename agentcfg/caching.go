@@ -0,0 +1,171 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CachingFetcher decorates a fetcher sending a request per query, such as
+// KibanaFetcher, caching its results so that agents polling simultaneously
+// do not overload its backend.
+//
+// Results are cached per service name and environment, and per attributes
+// of the querying agent affecting the result: agent name, tenant, instance
+// and insecure agent prefixes. Concurrent identical queries missing the cache result in
+// a single fetch, which is not canceled if the querying agents give up.
+//
+// Negative results, i.e. results without matching agent config and errors,
+// are cached for a distinct, usually shorter, duration. Cancellations of
+// fetches are not cached.
+//
+// The first query acknowledging a cached result, i.e. whose Etag matches the
+// result etag or which is marked as applied by agent, is sent to the fetcher
+// for it to record the agent config as applied. Further queries for the
+// unchanged result are served from the cache.
+type CachingFetcher struct {
+	fetcher   Fetcher
+	now       func() time.Time
+	nextPurge time.Time
+	entries   map[string]cachingFetcherEntry
+	group     singleflight.Group
+	// ttl holds the duration results are cached for.
+	ttl time.Duration
+	// negativeTTL holds the duration negative results are cached for.
+	negativeTTL time.Duration
+	mu          sync.Mutex
+}
+
+type cachingFetcherEntry struct {
+	expires time.Time
+	err     error
+	result  Result
+	// applied reports whether the fetcher was sent a query acknowledging
+	// result, or whether result needs no acknowledgement.
+	applied bool
+}
+
+// NewCachingFetcher returns a CachingFetcher caching the results of fetcher
+// for ttl, and its negative results for negativeTTL. Negative results are
+// not cached if negativeTTL is not positive.
+func NewCachingFetcher(fetcher Fetcher, ttl, negativeTTL time.Duration) *CachingFetcher {
+	return &CachingFetcher{
+		fetcher:     fetcher,
+		now:         time.Now,
+		entries:     make(map[string]cachingFetcherEntry),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// Fetch returns the cached result of query, fetching it if it is not
+// cached, expired, or acknowledged for the first time.
+func (f *CachingFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	key := cachingFetcherKey(ctx, query)
+	f.mu.Lock()
+	entry, ok := f.entries[key]
+	f.mu.Unlock()
+	if ok && f.now().Before(entry.expires) &&
+		(entry.applied || !acknowledges(query, entry.result)) {
+		return entry.result, entry.err
+	}
+
+	// Queries acknowledging different etags are fetched separately, so
+	// that the fetcher receives every acknowledgement.
+	flightKey := key + "\x00" + query.Etag + "\x00" + strconv.FormatBool(query.MarkAsAppliedByAgent)
+	ch := f.group.DoChan(flightKey, func() (interface{}, error) {
+		result, err := f.fetcher.Fetch(context.WithoutCancel(ctx), query)
+		f.store(key, query, result, err)
+		return result, err
+	})
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return Result{}, res.Err
+		}
+		return res.Val.(Result), nil
+	}
+}
+
+// store caches the result of query, purging expired entries at most once
+// per ttl.
+func (f *CachingFetcher) store(key string, query Query, result Result, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	negative := err != nil || result.Source.Etag == EtagSentinel
+	ttl := f.ttl
+	if negative {
+		ttl = f.negativeTTL
+	}
+	now := f.now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !now.Before(f.nextPurge) {
+		for k, entry := range f.entries {
+			if !now.Before(entry.expires) {
+				delete(f.entries, k)
+			}
+		}
+		f.nextPurge = now.Add(f.ttl)
+	}
+	if ttl <= 0 {
+		delete(f.entries, key)
+		return
+	}
+	f.entries[key] = cachingFetcherEntry{
+		expires: now.Add(ttl),
+		err:     err,
+		result:  result,
+		applied: negative || acknowledges(query, result),
+	}
+}
+
+// acknowledges reports whether query acknowledges that the agent applied
+// the agent config of result.
+func acknowledges(query Query, result Result) bool {
+	return query.MarkAsAppliedByAgent || query.Etag == result.Source.Etag
+}
+
+// cachingFetcherKey returns the key of the cached result of query.
+func cachingFetcherKey(ctx context.Context, query Query) string {
+	tenant := query.Tenant
+	if tenant == "" {
+		tenant, _ = TenantFromContext(ctx)
+	}
+	parts := []string{query.Service.Name, query.Service.Environment, query.AgentName, tenant}
+	if query.Instance != nil {
+		parts = append(parts, query.Instance.NodeName, query.Instance.HostName)
+		for _, k := range sortedKeys(query.Instance.Labels) {
+			parts = append(parts, k+"="+query.Instance.Labels[k])
+		}
+	}
+	parts = append(parts, "")
+	parts = append(parts, query.InsecureAgents...)
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,172 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCachingFetcher(fetchFn func(context.Context, Query) (Result, error)) (*CachingFetcher, *[]Query, *time.Time) {
+	var queries []Query
+	now := time.Now()
+	f := NewCachingFetcher(&fetcherMock{fetchFn: func(ctx context.Context, query Query) (Result, error) {
+		queries = append(queries, query)
+		return fetchFn(ctx, query)
+	}}, time.Minute, 10*time.Second)
+	f.now = func() time.Time { return now }
+	return f, &queries, &now
+}
+
+func TestCachingFetcher(t *testing.T) {
+	cfgs := []AgentConfig{
+		{ServiceName: "opbeans", Config: map[string]string{"capture_body": "all"}, Etag: "opbeans"},
+		{ServiceName: "opbeans", ServiceEnvironment: "production", Config: map[string]string{"capture_body": "off"}, Etag: "production"},
+	}
+	f, queries, now := newTestCachingFetcher(func(_ context.Context, query Query) (Result, error) {
+		return MatchAgentConfig(query, cfgs), nil
+	})
+	fetch := func(query Query) Result {
+		result, err := f.Fetch(context.Background(), query)
+		require.NoError(t, err)
+		return result
+	}
+
+	query := Query{Service: Service{Name: "opbeans"}}
+	assert.Equal(t, "opbeans", fetch(query).Source.Etag)
+	assert.Equal(t, "opbeans", fetch(query).Source.Etag)
+	assert.Len(t, *queries, 1)
+
+	// Results are cached per environment, tenant and instance.
+	assert.Equal(t, "production", fetch(Query{Service: Service{Name: "opbeans", Environment: "production"}}).Source.Etag)
+	fetch(Query{Service: Service{Name: "opbeans"}, Tenant: "other"})
+	fetch(Query{Service: Service{Name: "opbeans"}, Instance: &Instance{Labels: map[string]string{"region": "eu"}}})
+	fetch(Query{Service: Service{Name: "opbeans"}, Instance: &Instance{Labels: map[string]string{"region": "eu"}}})
+	assert.Len(t, *queries, 4)
+
+	// Cached results expire after the ttl.
+	*now = now.Add(time.Minute)
+	fetch(query)
+	assert.Len(t, *queries, 5)
+}
+
+func TestCachingFetcherEtag(t *testing.T) {
+	f, queries, _ := newTestCachingFetcher(func(_ context.Context, query Query) (Result, error) {
+		return Result{Source: Source{Settings: Settings{"capture_body": "all"}, Etag: "abc"}}, nil
+	})
+	fetch := func(query Query) {
+		result, err := f.Fetch(context.Background(), query)
+		require.NoError(t, err)
+		assert.Equal(t, "abc", result.Source.Etag)
+	}
+
+	fetch(Query{Service: Service{Name: "opbeans"}})
+	fetch(Query{Service: Service{Name: "opbeans"}, Etag: "old"})
+	assert.Len(t, *queries, 1)
+
+	// The first acknowledgement is sent to the fetcher, others are cached.
+	fetch(Query{Service: Service{Name: "opbeans"}, Etag: "abc"})
+	fetch(Query{Service: Service{Name: "opbeans"}, Etag: "abc"})
+	fetch(Query{Service: Service{Name: "opbeans"}, MarkAsAppliedByAgent: true})
+	require.Len(t, *queries, 2)
+	assert.Equal(t, "abc", (*queries)[1].Etag)
+
+	// Results fetched with their acknowledgement need none.
+	fetch(Query{Service: Service{Name: "other"}, MarkAsAppliedByAgent: true})
+	fetch(Query{Service: Service{Name: "other"}, Etag: "abc"})
+	assert.Len(t, *queries, 3)
+}
+
+func TestCachingFetcherNegative(t *testing.T) {
+	var fetchErr error
+	f, queries, now := newTestCachingFetcher(func(_ context.Context, query Query) (Result, error) {
+		if fetchErr != nil {
+			return Result{}, fetchErr
+		}
+		return zeroResult(), nil
+	})
+
+	for i := 0; i < 2; i++ {
+		result, err := f.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}, Etag: EtagSentinel})
+		require.NoError(t, err)
+		assert.Equal(t, zeroResult(), result)
+	}
+	assert.Len(t, *queries, 1)
+
+	// Negative results expire after the negative ttl.
+	*now = now.Add(10 * time.Second)
+	fetchErr = ErrNotReady
+	for i := 0; i < 2; i++ {
+		_, err := f.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+		assert.EqualError(t, err, ErrInfrastructureNotReady)
+	}
+	assert.Len(t, *queries, 2)
+
+	// Cancellations are not cached.
+	fetchErr = context.Canceled
+	for i := 0; i < 2; i++ {
+		_, err := f.Fetch(context.Background(), Query{Service: Service{Name: "other"}})
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Len(t, *queries, 4)
+}
+
+func TestCachingFetcherSingleflight(t *testing.T) {
+	var fetches atomic.Int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	f := NewCachingFetcher(&fetcherMock{fetchFn: func(_ context.Context, query Query) (Result, error) {
+		if fetches.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return Result{Source: Source{Settings: Settings{"capture_body": "all"}, Etag: "abc"}}, nil
+	}}, time.Minute, time.Minute)
+
+	query := Query{Service: Service{Name: "opbeans"}}
+	var wg sync.WaitGroup
+	fetch := func() {
+		defer wg.Done()
+		result, err := f.Fetch(context.Background(), query)
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", result.Source.Etag)
+	}
+	wg.Add(1)
+	go fetch()
+	<-started
+
+	// Callers giving up do not cancel the shared fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := f.Fetch(ctx, query)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go fetch()
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int64(1), fetches.Load())
+}
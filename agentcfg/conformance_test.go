@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+	"github.com/elastic/opentelemetry-lib/agentcfg/agentcfgtest"
+)
+
+func TestElasticsearchFetcherConformance(t *testing.T) {
+	agentcfgtest.Suite{
+		NewFetcher: func(t *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher {
+			fetcher := agentcfg.NewMockElasticsearchFetcher(t, cfgs)
+			require.NoError(t, agentcfg.RefreshCache(fetcher, context.Background()))
+			return fetcher
+		},
+		NewNotReadyFetcher: func(t *testing.T) agentcfg.Fetcher {
+			return agentcfg.NewMockElasticsearchFetcher(t, nil)
+		},
+	}.Run(t)
+}
+
+func TestFileFetcherConformance(t *testing.T) {
+	agentcfgtest.Suite{
+		NewFetcher: func(t *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher {
+			type service struct {
+				Name        string `json:"name,omitempty"`
+				Environment string `json:"environment,omitempty"`
+			}
+			type entry struct {
+				Settings  map[string]string `json:"settings"`
+				Service   service           `json:"service"`
+				AgentName string            `json:"agent_name,omitempty"`
+			}
+			entries := []entry{}
+			for _, cfg := range cfgs {
+				entries = append(entries, entry{
+					Settings:  cfg.Config,
+					Service:   service{Name: cfg.ServiceName, Environment: cfg.ServiceEnvironment},
+					AgentName: cfg.AgentName,
+				})
+			}
+			b, err := json.Marshal(entries)
+			require.NoError(t, err)
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "agentcfg.json"), b, 0o644))
+
+			fetcher := agentcfg.NewFileFetcher(dir, time.Hour, zap.NewNop())
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- fetcher.Run(ctx) }()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+			require.Eventually(t, func() bool {
+				_, err := fetcher.Fetch(ctx, agentcfg.Query{})
+				return err == nil
+			}, 10*time.Second, time.Millisecond)
+			return fetcher
+		},
+		NewNotReadyFetcher: func(t *testing.T) agentcfg.Fetcher {
+			return agentcfg.NewFileFetcher(t.TempDir(), time.Hour, zap.NewNop())
+		},
+		ComputesEtags: true,
+	}.Run(t)
+}
+
+func TestKibanaFetcherConformance(t *testing.T) {
+	newKibanaFetcher := func(t *testing.T, handler http.HandlerFunc) agentcfg.Fetcher {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		return agentcfg.NewKibanaFetcher(srv.Client(), srv.URL, zap.NewNop())
+	}
+	agentcfgtest.Suite{
+		NewFetcher: func(t *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher {
+			// Kibana searches agent configs as MatchAgentConfig does, and
+			// returns 404 if none matches.
+			return newKibanaFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+				var query agentcfg.Query
+				if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				result := agentcfg.MatchAgentConfig(query, cfgs)
+				if result.Source.Etag == agentcfg.EtagSentinel {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(result)
+			})
+		},
+		NewNotReadyFetcher: func(t *testing.T) agentcfg.Fetcher {
+			return newKibanaFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+		},
+		IgnoresAgentNames: true,
+	}.Run(t)
+}
+
+func TestCachingFetcherConformance(t *testing.T) {
+	agentcfgtest.Suite{
+		NewFetcher: func(t *testing.T, cfgs []agentcfg.AgentConfig) agentcfg.Fetcher {
+			fetcher := agentcfg.NewMockElasticsearchFetcher(t, cfgs)
+			require.NoError(t, agentcfg.RefreshCache(fetcher, context.Background()))
+			return agentcfg.NewCachingFetcher(fetcher, time.Minute, time.Minute)
+		},
+		NewNotReadyFetcher: func(t *testing.T) agentcfg.Fetcher {
+			return agentcfg.NewCachingFetcher(agentcfg.NewMockElasticsearchFetcher(t, nil), time.Minute, time.Minute)
+		},
+	}.Run(t)
+}
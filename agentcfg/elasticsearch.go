@@ -18,16 +18,22 @@
 package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 	"go.uber.org/zap"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -39,7 +45,8 @@ const ElasticsearchIndexName = ".apm-agent-configuration"
 const (
 	// ErrInfrastructureNotReady is returned when a fetch request comes in while
 	// the infrastructure is not ready to serve the request.
-	// This may happen when the local cache is not initialized and no fallback fetcher is configured.
+	// This may happen when the local cache is not initialized and no fallback fetcher
+	// is configured, see FallbackFetcher.
 	ErrInfrastructureNotReady = "agentcfg infrastructure is not ready"
 
 	// ErrNoValidElasticsearchConfig is an error where the server is
@@ -47,37 +54,203 @@ const (
 	ErrNoValidElasticsearchConfig = "no valid elasticsearch config to fetch agent config"
 )
 
+var (
+	// ErrNotReady is the error holding the ErrInfrastructureNotReady
+	// message returned by fetchers, to be matched with errors.Is.
+	ErrNotReady = errors.New(ErrInfrastructureNotReady)
+
+	// ErrInvalidElasticsearchConfig is the error holding the
+	// ErrNoValidElasticsearchConfig message returned by fetchers, to be
+	// matched with errors.Is.
+	ErrInvalidElasticsearchConfig = errors.New(ErrNoValidElasticsearchConfig)
+)
+
 const (
 	refreshCacheTimeout = 5 * time.Second
 	loggerRateLimit     = time.Minute
+	defaultSearchSize   = 100
+	// pitKeepAlive is the time a point in time is kept alive between
+	// two consecutive page requests.
+	pitKeepAlive = "1m"
+
+	defaultInvalidConfigRetryInterval    = 5 * time.Second
+	defaultInvalidConfigMaxRetryInterval = 5 * time.Minute
 )
 
-// TODO:
-// - Add Otel tracer
-// - Collection metrics
+// ElasticsearchFetcher serves agent configurations from a cache of the
+// agent configuration index, refreshed periodically by Run.
 type ElasticsearchFetcher struct {
-	last             time.Time
-	client           *elasticsearch.Client
-	logger           *zap.Logger
-	cache            []AgentConfig
-	cacheDuration    time.Duration
-	searchSize       int
+	telemetry     elasticsearchTelemetry
+	meterProvider metric.MeterProvider
+	// telemetryAttrs holds attributes added to all metrics.
+	telemetryAttrs []attribute.KeyValue
+	clientUpdated  chan struct{}
+	acker          *appliedByAgentAcker
+	auditSink      AuditSink
+	logger         *zap.Logger
+	client         atomic.Pointer[elasticsearch.Client]
+	// snapshotPath, if set, holds the path of the file the cache is
+	// persisted to, see WithSnapshot.
+	snapshotPath string
+	index        string
+	cache        agentConfigIndex
+	watchers     watchers
+	lastState    cacheState
+	searchSize   int
+	// retryInterval and maxRetryInterval bound the capped exponential
+	// intervals between refreshes while the Elasticsearch config is invalid.
+	retryInterval        time.Duration
+	maxRetryInterval     time.Duration
+	refreshTimeout       time.Duration
+	cacheDuration        time.Duration
+	snapshotMaxStaleness time.Duration
+	// lastRefresh holds the time of the last successful refresh,
+	// in nanoseconds since the Unix epoch.
+	lastRefresh      atomic.Int64
 	mu               sync.RWMutex
 	invalidESCfg     atomic.Bool
 	cacheInitialized atomic.Bool
 }
 
+// ElasticsearchFetcherOption configures optional behaviour of an
+// ElasticsearchFetcher.
+type ElasticsearchFetcherOption func(*ElasticsearchFetcher)
+
+// WithAppliedByAgentAck enables recording in Elasticsearch that an agent
+// configuration has been applied, when an agent queries with the current
+// etag of the configuration or the query is marked as applied by the agent.
+// Acknowledgements are batched and written at most once per flushInterval,
+// and pending acknowledgements are written once more when Run returns.
+//
+// This requires the Elasticsearch credentials to have write access to the
+// agent configuration index.
+func WithAppliedByAgentAck(flushInterval time.Duration) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.acker = newAppliedByAgentAcker(flushInterval)
+	}
+}
+
+// WithIndex sets the name of the index holding the agent configurations.
+// Defaults to ElasticsearchIndexName. The index is expected to have a single
+// shard, the Elasticsearch default: otherwise, modifications which change
+// neither the number of agent configurations nor their latest @timestamp
+// may go undetected until another modification, see cacheState.
+func WithIndex(index string) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.index = index
+	}
+}
+
+// WithSearchSize sets the number of agent configurations requested per page
+// when refreshing the cache. Defaults to 100, which is also used if size is
+// not positive.
+func WithSearchSize(size int) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		if size <= 0 {
+			size = defaultSearchSize
+		}
+		f.searchSize = size
+	}
+}
+
+// WithRefreshTimeout sets the maximum duration of a cache refresh.
+// Defaults to 5 seconds.
+func WithRefreshTimeout(timeout time.Duration) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.refreshTimeout = timeout
+	}
+}
+
+// WithInvalidConfigRetry sets the intervals between refreshes while
+// Elasticsearch rejects the fetcher credentials with 401 or 403 responses.
+// Refreshes are retried with exponential intervals starting at interval,
+// capped at maxInterval. Defaults to 5 seconds and 5 minutes, which are also
+// used for intervals that are not positive. maxInterval is raised to interval
+// if lower.
+func WithInvalidConfigRetry(interval, maxInterval time.Duration) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		if interval <= 0 {
+			interval = defaultInvalidConfigRetryInterval
+		}
+		if maxInterval <= 0 {
+			maxInterval = defaultInvalidConfigMaxRetryInterval
+		}
+		f.retryInterval = interval
+		f.maxRetryInterval = max(interval, maxInterval)
+	}
+}
+
+// WithSnapshot enables persisting the agent config cache to the file at
+// path after each successful refresh. The snapshot is loaded when creating
+// the fetcher, so that agent configs can be served before Elasticsearch is
+// reachable, unless it was taken more than maxStaleness ago. A zero
+// maxStaleness disables the staleness check.
+func WithSnapshot(path string, maxStaleness time.Duration) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.snapshotPath = path
+		f.snapshotMaxStaleness = maxStaleness
+	}
+}
+
+// WithAuditSink sets the sink receiving the audit events of the agent
+// config changes detected by cache refreshes. Audit events are logged
+// regardless of the sink. The first refresh is only audited if the cache
+// was loaded from a snapshot, see WithSnapshot.
+func WithAuditSink(sink AuditSink) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.auditSink = sink
+	}
+}
+
+// WithMeterProvider sets the meter provider used to report the fetcher
+// metrics: the age and number of entries of the cache, the duration and
+// failures of cache refreshes, and the number of fetches by result.
+func WithMeterProvider(mp metric.MeterProvider) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.meterProvider = mp
+	}
+}
+
+// withTelemetryAttributes adds attrs to all metrics of the fetcher.
+func withTelemetryAttributes(attrs ...attribute.KeyValue) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		f.telemetryAttrs = attrs
+	}
+}
+
 func NewElasticsearchFetcher(
 	client *elasticsearch.Client,
 	cacheDuration time.Duration,
 	logger *zap.Logger,
+	opts ...ElasticsearchFetcherOption,
 ) *ElasticsearchFetcher {
-	return &ElasticsearchFetcher{
-		client:        client,
-		cacheDuration: cacheDuration,
-		searchSize:    100,
-		logger:        logger,
+	f := &ElasticsearchFetcher{
+		clientUpdated:    make(chan struct{}, 1),
+		cacheDuration:    cacheDuration,
+		index:            ElasticsearchIndexName,
+		searchSize:       defaultSearchSize,
+		refreshTimeout:   refreshCacheTimeout,
+		retryInterval:    defaultInvalidConfigRetryInterval,
+		maxRetryInterval: defaultInvalidConfigMaxRetryInterval,
+		logger:           logger,
+		meterProvider:    noop.NewMeterProvider(),
+	}
+	f.client.Store(client)
+	for _, opt := range opts {
+		opt(f)
+	}
+	telemetry, err := f.newTelemetry(f.meterProvider)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create agent config telemetry: %s", err))
+		telemetry, _ = f.newTelemetry(noop.NewMeterProvider())
+	}
+	f.telemetry = telemetry
+	if f.snapshotPath != "" {
+		if err := f.loadSnapshot(); err != nil {
+			logger.Warn(fmt.Sprintf("failed to load agent config snapshot: %s", err))
+		}
 	}
+	return f
 }
 
 // Fetch finds a matching agent config based on the received query.
@@ -86,32 +259,94 @@ func (f *ElasticsearchFetcher) Fetch(ctx context.Context, query Query) (Result,
 		// Happy path: serve fetch requests using an initialized cache.
 		f.mu.RLock()
 		defer f.mu.RUnlock()
-		return matchAgentConfig(query, f.cache), nil
+		cfg := f.cache.find(query)
+		if cfg == nil {
+			f.telemetry.recordFetch(ctx, fetchResultMiss)
+			return zeroResult(), nil
+		}
+		f.telemetry.recordFetch(ctx, fetchResultHit)
+		settings, etag := cfg.resolve(query)
+		// Only the rolled out settings are acknowledged, applied_by_agent
+		// refers to the etag of the document.
+		if f.acker != nil && !cfg.AppliedByAgent && cfg.ID != "" && etag == cfg.Etag &&
+			(query.MarkAsAppliedByAgent || query.Etag == cfg.Etag) {
+			f.acker.add(cfg.ID, cfg.Etag)
+		}
+		return restrictSettings(query, Result{Source{
+			Settings: settings,
+			Etag:     etag,
+			Agent:    cfg.AgentName,
+		}}, UnrestrictedSettings), nil
 	}
 
+	f.telemetry.recordFetch(ctx, fetchResultNotReady)
 	if f.invalidESCfg.Load() {
-		return Result{}, errors.New(ErrNoValidElasticsearchConfig)
+		return Result{}, ErrInvalidElasticsearchConfig
 	}
 
-	return Result{}, errors.New(ErrInfrastructureNotReady)
+	return Result{}, ErrNotReady
+}
+
+// Watch returns a channel receiving the agent config of service whenever
+// it changes after a cache refresh. See Watcher.
+func (f *ElasticsearchFetcher) Watch(ctx context.Context, service Service) <-chan Result {
+	return f.watchers.watch(ctx, service)
+}
+
+// SetClient replaces the client used to query Elasticsearch, e.g. after
+// its credentials have been rotated. If Run is in progress, the cache is
+// refreshed with the new client immediately.
+func (f *ElasticsearchFetcher) SetClient(client *elasticsearch.Client) {
+	f.client.Store(client)
+	select {
+	case f.clientUpdated <- struct{}{}:
+	default:
+	}
 }
 
 // Run refreshes the fetcher cache by querying Elasticsearch periodically.
+// While Elasticsearch rejects the fetcher credentials, refreshes are retried
+// with capped exponential intervals until they succeed, see
+// WithInvalidConfigRetry and SetClient. When Run returns, the cache gauges
+// are no longer reported.
 func (f *ElasticsearchFetcher) Run(ctx context.Context) error {
-	refresh := func() bool {
-		// refresh returns a bool that indicates whether Run should return
-		// immediately without error, e.g. due to invalid Elasticsearch config.
-		if err := f.refreshCache(ctx); err != nil {
+	defer func() {
+		if err := f.telemetry.unregister(); err != nil {
+			f.logger.Warn(fmt.Sprintf("failed to unregister agent config telemetry: %s", err))
+		}
+	}()
+	if f.acker != nil {
+		// Write the pending acknowledgements, which would be lost otherwise,
+		// even though ctx is done.
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalAckFlushTimeout)
+			defer cancel()
+			if err := f.acker.flush(ctx, f.client.Load(), f.index); err != nil {
+				f.logger.Warn(fmt.Sprintf("applied by agent acknowledgement error: %s", err))
+			}
+		}()
+	}
 
+	retry := backoff.NewExponentialBackOff()
+	retry.InitialInterval = f.retryInterval
+	retry.MaxInterval = f.maxRetryInterval
+	retry.MaxElapsedTime = 0
+	retry.Reset()
+
+	// refresh returns the delay until the next refresh.
+	refresh := func() time.Duration {
+		if err := f.refreshCache(ctx); err != nil {
 			f.logger.Error(fmt.Sprintf("refresh cache error: %s", err))
 			if f.invalidESCfg.Load() {
-				f.logger.Warn("stopping refresh cache background job: elasticsearch config is invalid")
-				return true
+				delay := retry.NextBackOff()
+				f.logger.Warn(fmt.Sprintf("elasticsearch config is invalid, retrying refresh cache in %s", delay))
+				return delay
 			}
 		} else {
 			f.logger.Debug("refresh cache success")
 		}
-		return false
+		retry.Reset()
+		return f.cacheDuration
 	}
 
 	// Trigger initial run.
@@ -119,132 +354,328 @@ func (f *ElasticsearchFetcher) Run(ctx context.Context) error {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
-		if stop := refresh(); stop {
-			return nil
-		}
 	}
+	t := time.NewTimer(refresh())
+	defer t.Stop()
 
 	// Then schedule subsequent runs.
-	t := time.NewTicker(f.cacheDuration)
-	defer t.Stop()
+	var ackC <-chan time.Time
+	if f.acker != nil {
+		ackTicker := time.NewTicker(f.acker.flushInterval)
+		defer ackTicker.Stop()
+		ackC = ackTicker.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-t.C:
-			if stop := refresh(); stop {
-				return nil
+			t.Reset(refresh())
+		case <-f.clientUpdated:
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(refresh())
+		case <-ackC:
+			if err := f.acker.flush(ctx, f.client.Load(), f.index); err != nil {
+				f.logger.Warn(fmt.Sprintf("applied by agent acknowledgement error: %s", err))
 			}
 		}
 	}
 }
 
-type cacheResult struct {
-	ScrollID string `json:"_scroll_id"`
-	Hits     struct {
+// cacheState summarizes the contents of the agent configuration index, and
+// is used to detect whether the cache needs to be reloaded.
+type cacheState struct {
+	maxTimestamp float64
+	count        int64
+	// maxSeqNo and primaryTerm identify the latest document write, so that
+	// modifications are detected regardless of the document timestamps,
+	// which may come from writers with skewed clocks. Sequence numbers are
+	// per shard, so this only holds for indices with a single shard: with
+	// several shards, maxSeqNo is the one of the shard with the most writes.
+	maxSeqNo    int64
+	primaryTerm int64
+}
+
+type cacheStateResult struct {
+	Aggregations struct {
+		MaxTimestamp struct {
+			Value *float64 `json:"value"`
+		} `json:"max_timestamp"`
+	} `json:"aggregations"`
+	Hits struct {
 		Hits []struct {
-			Source struct {
-				Settings map[string]string `json:"settings"`
-				Service  struct {
-					Name        string `json:"name"`
-					Environment string `json:"environment"`
-				} `json:"service"`
-				AgentName string `json:"agent_name"`
-				ETag      string `json:"etag"`
-			} `json:"_source"`
+			SeqNo       int64 `json:"_seq_no"`
+			PrimaryTerm int64 `json:"_primary_term"`
 		} `json:"hits"`
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+	} `json:"hits"`
+}
+
+type cacheResult struct {
+	PitID string `json:"pit_id"`
+	Hits  struct {
+		Hits []cacheHit `json:"hits"`
 	} `json:"hits"`
 }
 
+// cacheHit is an agent configuration document.
+type cacheHit struct {
+	ID     string `json:"_id"`
+	Source struct {
+		Settings Settings          `json:"settings"`
+		Labels   map[string]string `json:"labels"`
+		Service  struct {
+			Node struct {
+				Name string `json:"name"`
+			} `json:"node"`
+			Name        string `json:"name"`
+			Environment string `json:"environment"`
+		} `json:"service"`
+		Host struct {
+			Name string `json:"name"`
+		} `json:"host"`
+		Rollout *struct {
+			Baseline struct {
+				Settings Settings `json:"settings"`
+				ETag     string   `json:"etag"`
+			} `json:"baseline"`
+			Percentage float64 `json:"percentage"`
+		} `json:"rollout"`
+		AgentName      string `json:"agent_name"`
+		ETag           string `json:"etag"`
+		AppliedByAgent bool   `json:"applied_by_agent"`
+	} `json:"_source"`
+	Sort []interface{} `json:"sort"`
+}
+
+func (hit *cacheHit) agentConfig() AgentConfig {
+	var rollout *Rollout
+	if r := hit.Source.Rollout; r != nil {
+		rollout = &Rollout{
+			Baseline:     r.Baseline.Settings,
+			BaselineEtag: r.Baseline.ETag,
+			Percentage:   r.Percentage,
+		}
+	}
+	return AgentConfig{
+		ServiceName:        hit.Source.Service.Name,
+		ServiceEnvironment: hit.Source.Service.Environment,
+		AgentName:          hit.Source.AgentName,
+		Etag:               hit.Source.ETag,
+		Config:             hit.Source.Settings,
+		ID:                 hit.ID,
+		AppliedByAgent:     hit.Source.AppliedByAgent,
+		Instance: Instance{
+			NodeName: hit.Source.Service.Node.Name,
+			HostName: hit.Source.Host.Name,
+			Labels:   hit.Source.Labels,
+		},
+		Rollout: rollout,
+	}
+}
+
 func (f *ElasticsearchFetcher) refreshCache(ctx context.Context) (err error) {
-	scrollID := ""
-	buffer := make([]AgentConfig, 0, len(f.cache))
+	defer func(start time.Time) {
+		f.telemetry.recordRefresh(ctx, start, err)
+		if err == nil && f.invalidESCfg.Swap(false) {
+			f.logger.Info("elasticsearch config is valid again")
+		}
+		if err == nil && f.snapshotPath != "" {
+			if err := f.writeSnapshot(time.Unix(0, f.lastRefresh.Load())); err != nil {
+				f.logger.Warn(fmt.Sprintf("failed to write agent config snapshot: %s", err))
+			}
+		}
+	}(time.Now())
 
-	// The refresh cache operation should complete within refreshCacheTimeout.
-	ctx, cancel := context.WithTimeout(ctx, refreshCacheTimeout)
+	// The refresh cache operation should complete within refreshTimeout.
+	ctx, cancel := context.WithTimeout(ctx, f.refreshTimeout)
 	defer cancel()
 
+	state, err := f.cacheState(ctx)
+	if err != nil {
+		return err
+	}
+	if f.cacheInitialized.Load() && state == f.lastState {
+		f.logger.Debug("agent configuration unchanged, skipping cache reload")
+		f.lastRefresh.Store(time.Now().UnixNano())
+		return nil
+	}
+
+	pitID, err := f.openPointInTime(ctx)
+	if err != nil {
+		return err
+	}
+	// Close the point in time even if the refresh context is done,
+	// so that it is not kept open until its keep alive expires.
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), f.refreshTimeout)
+		defer cancel()
+		f.closePointInTime(closeCtx, pitID)
+	}()
+
+	buffer := make([]AgentConfig, 0, len(f.cache.cfgs))
+	var searchAfter []interface{}
 	for {
-		result, err := f.singlePageRefresh(ctx, scrollID)
+		result, err := f.singlePageRefresh(ctx, pitID, searchAfter)
 		if err != nil {
-			f.clearScroll(ctx, scrollID)
 			return err
 		}
+		if result.PitID != "" {
+			pitID = result.PitID
+		}
 
 		for _, hit := range result.Hits.Hits {
-			buffer = append(buffer, AgentConfig{
-				ServiceName:        hit.Source.Service.Name,
-				ServiceEnvironment: hit.Source.Service.Environment,
-				AgentName:          hit.Source.AgentName,
-				Etag:               hit.Source.ETag,
-				Config:             hit.Source.Settings,
-			})
-		}
-		scrollID = result.ScrollID
-		if len(result.Hits.Hits) == 0 {
+			buffer = append(buffer, hit.agentConfig())
+		}
+		if len(result.Hits.Hits) == 0 || len(result.Hits.Hits) < f.searchSize {
 			break
 		}
+		searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
 	}
 
-	f.clearScroll(ctx, scrollID)
+	sanitizeAgentConfigs(buffer, f.logger)
 
+	index := newAgentConfigIndex(buffer)
 	f.mu.Lock()
-	f.cache = buffer
+	old := f.cache.cfgs
+	f.cache = index
 	f.mu.Unlock()
-	f.cacheInitialized.Store(true)
-	f.last = time.Now()
+	if f.acker != nil {
+		f.acker.prune(buffer)
+	}
+	if f.cacheInitialized.Swap(true) {
+		f.audit(ctx, old, buffer)
+	}
+	f.watchers.update(index)
+	f.lastState = state
+	f.lastRefresh.Store(time.Now().UnixNano())
 	return nil
 }
 
-func (f *ElasticsearchFetcher) clearScroll(ctx context.Context, scrollID string) {
-	resp, err := esapi.ClearScrollRequest{
-		ScrollID: []string{scrollID},
-	}.Do(ctx, f.client)
+// cacheState queries the number of agent configurations, their latest
+// modification timestamp and the sequence number of the latest write.
+func (f *ElasticsearchFetcher) cacheState(ctx context.Context) (cacheState, error) {
+	resp, err := esapi.SearchRequest{
+		Index: []string{f.index},
+		Body: strings.NewReader(
+			`{"size":1,"_source":false,"seq_no_primary_term":true,"sort":[{"_seq_no":"desc"}],` +
+				`"track_total_hits":true,"aggs":{"max_timestamp":{"max":{"field":"@timestamp"}}}}`,
+		),
+	}.Do(ctx, f.client.Load())
 	if err != nil {
-		f.logger.Warn(fmt.Sprintf("failed to clear scroll: %v", err))
+		return cacheState{}, err
+	}
+	defer resp.Body.Close()
+	if err := f.checkResponse(resp); err != nil {
+		return cacheState{}, err
+	}
+
+	var result cacheStateResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return cacheState{}, err
+	}
+	state := cacheState{count: result.Hits.Total.Value}
+	if result.Aggregations.MaxTimestamp.Value != nil {
+		state.maxTimestamp = *result.Aggregations.MaxTimestamp.Value
+	}
+	if len(result.Hits.Hits) > 0 {
+		state.maxSeqNo = result.Hits.Hits[0].SeqNo
+		state.primaryTerm = result.Hits.Hits[0].PrimaryTerm
+	}
+	return state, nil
+}
+
+func (f *ElasticsearchFetcher) openPointInTime(ctx context.Context) (string, error) {
+	resp, err := esapi.OpenPointInTimeRequest{
+		Index:     []string{f.index},
+		KeepAlive: pitKeepAlive,
+	}.Do(ctx, f.client.Load())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := f.checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.ID, nil
+}
+
+func (f *ElasticsearchFetcher) closePointInTime(ctx context.Context, pitID string) {
+	body, err := json.Marshal(map[string]string{"id": pitID})
+	if err != nil {
+		f.logger.Warn(fmt.Sprintf("failed to close point in time: %v", err))
+		return
+	}
+	resp, err := esapi.ClosePointInTimeRequest{
+		Body: bytes.NewReader(body),
+	}.Do(ctx, f.client.Load())
+	if err != nil {
+		f.logger.Warn(fmt.Sprintf("failed to close point in time: %v", err))
 		return
 	}
 
 	if resp.IsError() {
-		f.logger.Warn(fmt.Sprintf("clearscroll request returned error: %s", resp.Status()))
+		f.logger.Warn(fmt.Sprintf("close point in time request returned error: %s", resp.Status()))
 	}
 
 	resp.Body.Close()
 }
 
-func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, scrollID string) (cacheResult, error) {
+func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, pitID string, searchAfter []interface{}) (cacheResult, error) {
 	var result cacheResult
-	var err error
-	var resp *esapi.Response
-
-	switch scrollID {
-	case "":
-		resp, err = esapi.SearchRequest{
-			Index:  []string{ElasticsearchIndexName},
-			Size:   &f.searchSize,
-			Scroll: f.cacheDuration,
-		}.Do(ctx, f.client)
-	default:
-		resp, err = esapi.ScrollRequest{
-			ScrollID: scrollID,
-			Scroll:   f.cacheDuration,
-		}.Do(ctx, f.client)
+	req := map[string]interface{}{
+		"size": f.searchSize,
+		"pit":  map[string]string{"id": pitID, "keep_alive": pitKeepAlive},
+		"sort": []map[string]string{{"_shard_doc": "asc"}},
+	}
+	if searchAfter != nil {
+		req["search_after"] = searchAfter
 	}
+	body, err := json.Marshal(req)
 	if err != nil {
 		return result, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= http.StatusBadRequest {
-		// Elasticsearch returns 401 on unauthorized requests and 403 on insufficient permission
-		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-			f.invalidESCfg.Store(true)
-		}
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err == nil {
-			f.logger.Debug(fmt.Sprintf("refresh cache elasticsearch returned status %d: %s", resp.StatusCode, string(bodyBytes)))
-		}
-		return result, fmt.Errorf("refresh cache elasticsearch returned status %d", resp.StatusCode)
+	resp, err := esapi.SearchRequest{
+		Body: bytes.NewReader(body),
+	}.Do(ctx, f.client.Load())
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if err := f.checkResponse(resp); err != nil {
+		return result, err
 	}
 	return result, json.NewDecoder(resp.Body).Decode(&result)
 }
+
+// checkResponse returns an error if Elasticsearch returned an error status,
+// and marks the Elasticsearch config invalid on authorization errors.
+func (f *ElasticsearchFetcher) checkResponse(resp *esapi.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	// Elasticsearch returns 401 on unauthorized requests and 403 on insufficient permission
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		f.invalidESCfg.Store(true)
+	}
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err == nil {
+		f.logger.Debug(fmt.Sprintf("refresh cache elasticsearch returned status %d: %s", resp.StatusCode, string(bodyBytes)))
+	}
+	return &statusError{statusCode: resp.StatusCode}
+}
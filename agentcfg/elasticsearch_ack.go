@@ -0,0 +1,195 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// maxAckBatchSize limits the number of documents updated by a single flush.
+const maxAckBatchSize = 500
+
+// finalAckFlushTimeout limits the time spent writing the pending
+// acknowledgements when ElasticsearchFetcher.Run returns.
+const finalAckFlushTimeout = 5 * time.Second
+
+// appliedByAgentScript only marks a document as applied if its etag did not
+// change since the acknowledgement was recorded.
+const appliedByAgentScript = `if (ctx._source.etag == params.etag) { ctx._source.applied_by_agent = true } else { ctx.op = 'noop' }`
+
+// appliedByAgentAcker collects acknowledgements of applied agent
+// configurations and writes them to Elasticsearch in batches.
+type appliedByAgentAcker struct {
+	// pending holds the etags of the documents to update, keyed by ID.
+	pending map[string]string
+	// acked holds the etags of the documents already updated, or being
+	// updated, keyed by ID. It prevents updating documents repeatedly
+	// until the cache is refreshed, see prune.
+	acked         map[string]string
+	flushInterval time.Duration
+	mu            sync.Mutex
+}
+
+func newAppliedByAgentAcker(flushInterval time.Duration) *appliedByAgentAcker {
+	return &appliedByAgentAcker{
+		pending:       make(map[string]string),
+		acked:         make(map[string]string),
+		flushInterval: flushInterval,
+	}
+}
+
+// add records that the configuration with the given document ID and etag
+// has been applied by an agent.
+func (a *appliedByAgentAcker) add(id, etag string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.acked[id] == etag {
+		return
+	}
+	a.acked[id] = etag
+	a.pending[id] = etag
+}
+
+type bulkUpdateResult struct {
+	Items []struct {
+		Update struct {
+			Error *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+		} `json:"update"`
+	} `json:"items"`
+	Errors bool `json:"errors"`
+}
+
+// prune forgets the acknowledgements of the documents deleted, modified or
+// marked as applied since they were recorded, according to the refreshed
+// agent configurations cfgs.
+func (a *appliedByAgentAcker) prune(cfgs []AgentConfig) {
+	etags := make(map[string]string, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.ID != "" && !cfg.AppliedByAgent {
+			etags[cfg.ID] = cfg.Etag
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, etag := range a.acked {
+		if etags[id] != etag {
+			delete(a.acked, id)
+			delete(a.pending, id)
+		}
+	}
+}
+
+// flush writes up to maxAckBatchSize pending acknowledgements to the
+// agent configuration index. Failed acknowledgements are queued again and
+// retried on a later flush, until their document is deleted or modified.
+func (a *appliedByAgentAcker) flush(ctx context.Context, client *elasticsearch.Client, index string) error {
+	a.mu.Lock()
+	batch := make(map[string]string, min(len(a.pending), maxAckBatchSize))
+	for id, etag := range a.pending {
+		if len(batch) == maxAckBatchSize {
+			break
+		}
+		batch[id] = etag
+		delete(a.pending, id)
+	}
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for id, etag := range batch {
+		if err := enc.Encode(map[string]interface{}{"update": map[string]interface{}{"_id": id}}); err != nil {
+			return err
+		}
+		if err := enc.Encode(map[string]interface{}{"script": map[string]interface{}{
+			"source": appliedByAgentScript,
+			"lang":   "painless",
+			"params": map[string]interface{}{"etag": etag},
+		}}); err != nil {
+			return err
+		}
+	}
+
+	resp, err := esapi.BulkRequest{
+		Index: index,
+		Body:  &buf,
+	}.Do(ctx, client)
+	if err != nil {
+		a.retry(batch)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		a.retry(batch)
+		return fmt.Errorf("bulk update elasticsearch returned status %d", resp.StatusCode)
+	}
+
+	var result bulkUpdateResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		a.retry(batch)
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := make(map[string]string)
+	var firstErr error
+	for _, item := range result.Items {
+		// Documents deleted since the last cache refresh are not retried.
+		if item.Update.Error == nil || item.Update.Status == http.StatusNotFound {
+			continue
+		}
+		failed[item.Update.ID] = batch[item.Update.ID]
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", item.Update.Error.Type, item.Update.Error.Reason)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	a.retry(failed)
+	return fmt.Errorf("failed to update %d documents, first error: %w", len(failed), firstErr)
+}
+
+// retry queues the given acknowledgements again, unless they have been
+// pruned or superseded meanwhile.
+func (a *appliedByAgentAcker) retry(batch map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, etag := range batch {
+		if _, ok := a.pending[id]; !ok && a.acked[id] == etag {
+			a.pending[id] = etag
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// AuditEventType is the type of change of an agent config.
+type AuditEventType string
+
+const (
+	// AuditEventAdded is the type of events of added agent configs.
+	AuditEventAdded AuditEventType = "added"
+	// AuditEventRemoved is the type of events of removed agent configs.
+	AuditEventRemoved AuditEventType = "removed"
+	// AuditEventChanged is the type of events of changed agent configs.
+	AuditEventChanged AuditEventType = "changed"
+)
+
+// AuditEvent describes a change of an agent config detected by a cache
+// refresh.
+type AuditEvent struct {
+	Service Service
+	Type    AuditEventType
+	// ID holds the ID of the document of the agent config.
+	ID        string
+	AgentName string
+	// OldEtag and NewEtag hold the etags of the agent config before and
+	// after the change, OldEtag being empty for added agent configs and
+	// NewEtag for removed ones.
+	OldEtag string
+	NewEtag string
+	// ChangedKeys holds the sorted keys of the settings added, removed or
+	// changed.
+	ChangedKeys []string
+}
+
+// AuditSink receives the audit events of agent config changes.
+type AuditSink interface {
+	// Audit is called with the events of a cache refresh, ordered by
+	// service name, service environment and ID.
+	Audit(ctx context.Context, events []AuditEvent)
+}
+
+// audit logs and sends to the audit sink the changes between the agent
+// configs old and new.
+func (f *ElasticsearchFetcher) audit(ctx context.Context, old, new []AgentConfig) {
+	events := diffAgentConfigs(old, new)
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		f.logger.Info(
+			fmt.Sprintf("agent config %s for service %q environment %q", event.Type, event.Service.Name, event.Service.Environment),
+			zap.String("agent_config.id", event.ID),
+			zap.String("agent_config.agent_name", event.AgentName),
+			zap.Strings("agent_config.changed_keys", event.ChangedKeys),
+			zap.String("agent_config.old_etag", event.OldEtag),
+			zap.String("agent_config.new_etag", event.NewEtag),
+		)
+	}
+	if f.auditSink != nil {
+		f.auditSink.Audit(ctx, events)
+	}
+}
+
+// diffAgentConfigs returns the events of the changes between the agent
+// configs old and new. Agent configs are identified by their document ID,
+// and by their service and instance if they have none. An agent config is
+// changed if its etag, settings or rollout changed.
+func diffAgentConfigs(old, new []AgentConfig) []AuditEvent {
+	oldByKey := make(map[string]*AgentConfig, len(old))
+	for i := range old {
+		oldByKey[auditKey(&old[i])] = &old[i]
+	}
+	var events []AuditEvent
+	for i := range new {
+		cfg := &new[i]
+		key := auditKey(cfg)
+		prev, ok := oldByKey[key]
+		if !ok {
+			events = append(events, newAuditEvent(AuditEventAdded, cfg, nil))
+			continue
+		}
+		delete(oldByKey, key)
+		if prev.Etag != cfg.Etag || !maps.Equal(prev.Config, cfg.Config) || !reflect.DeepEqual(prev.Rollout, cfg.Rollout) {
+			events = append(events, newAuditEvent(AuditEventChanged, cfg, prev))
+		}
+	}
+	for _, prev := range oldByKey {
+		events = append(events, newAuditEvent(AuditEventRemoved, prev, nil))
+	}
+	slices.SortFunc(events, func(a, b AuditEvent) int {
+		return cmp.Or(
+			cmp.Compare(a.Service.Name, b.Service.Name),
+			cmp.Compare(a.Service.Environment, b.Service.Environment),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+	return events
+}
+
+func auditKey(cfg *AgentConfig) string {
+	if cfg.ID != "" {
+		return cfg.ID
+	}
+	return fmt.Sprintf(
+		"%q %q %q %q %q %v", cfg.ServiceName, cfg.ServiceEnvironment, cfg.AgentName,
+		cfg.Instance.NodeName, cfg.Instance.HostName, cfg.Instance.Labels,
+	)
+}
+
+// newAuditEvent returns the event of a change of cfg. For changed agent
+// configs, prev holds the agent config before the change.
+func newAuditEvent(typ AuditEventType, cfg, prev *AgentConfig) AuditEvent {
+	event := AuditEvent{
+		Type:      typ,
+		Service:   Service{Name: cfg.ServiceName, Environment: cfg.ServiceEnvironment},
+		ID:        cfg.ID,
+		AgentName: cfg.AgentName,
+	}
+	var oldSettings, newSettings map[string]string
+	switch typ {
+	case AuditEventAdded:
+		newSettings, event.NewEtag = cfg.Config, cfg.Etag
+	case AuditEventRemoved:
+		oldSettings, event.OldEtag = cfg.Config, cfg.Etag
+	case AuditEventChanged:
+		oldSettings, event.OldEtag = prev.Config, prev.Etag
+		newSettings, event.NewEtag = cfg.Config, cfg.Etag
+	}
+	for k, v := range newSettings {
+		if ov, ok := oldSettings[k]; !ok || ov != v {
+			event.ChangedKeys = append(event.ChangedKeys, k)
+		}
+	}
+	for k := range oldSettings {
+		if _, ok := newSettings[k]; !ok {
+			event.ChangedKeys = append(event.ChangedKeys, k)
+		}
+	}
+	slices.Sort(event.ChangedKeys)
+	return event
+}
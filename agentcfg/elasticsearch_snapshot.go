@@ -0,0 +1,149 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshot is the on-disk representation of the agent config cache.
+type cacheSnapshot struct {
+	// Timestamp holds the time of the refresh the snapshot was taken at.
+	Timestamp time.Time             `json:"timestamp"`
+	Configs   []snapshotAgentConfig `json:"configs"`
+}
+
+type snapshotAgentConfig struct {
+	Settings           map[string]string `json:"settings"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	Rollout            *Rollout          `json:"rollout,omitempty"`
+	ServiceName        string            `json:"service_name,omitempty"`
+	ServiceEnvironment string            `json:"service_environment,omitempty"`
+	AgentName          string            `json:"agent_name,omitempty"`
+	NodeName           string            `json:"node_name,omitempty"`
+	HostName           string            `json:"host_name,omitempty"`
+	Etag               string            `json:"etag"`
+	ID                 string            `json:"id,omitempty"`
+	AppliedByAgent     bool              `json:"applied_by_agent,omitempty"`
+}
+
+// writeSnapshot writes the cached agent configs to the snapshot file. The
+// file is replaced atomically, so that readers never see a partial write.
+func (f *ElasticsearchFetcher) writeSnapshot(timestamp time.Time) error {
+	f.mu.RLock()
+	snapshot := cacheSnapshot{
+		Timestamp: timestamp,
+		Configs:   make([]snapshotAgentConfig, 0, len(f.cache.cfgs)),
+	}
+	for _, cfg := range f.cache.cfgs {
+		snapshot.Configs = append(snapshot.Configs, snapshotAgentConfig{
+			Settings:           cfg.Config,
+			ServiceName:        cfg.ServiceName,
+			ServiceEnvironment: cfg.ServiceEnvironment,
+			AgentName:          cfg.AgentName,
+			NodeName:           cfg.Instance.NodeName,
+			HostName:           cfg.Instance.HostName,
+			Labels:             cfg.Instance.Labels,
+			Rollout:            cfg.Rollout,
+			Etag:               cfg.Etag,
+			ID:                 cfg.ID,
+			AppliedByAgent:     cfg.AppliedByAgent,
+		})
+	}
+	b, err := json.Marshal(snapshot)
+	f.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.snapshotPath), filepath.Base(f.snapshotPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.snapshotPath)
+}
+
+// loadSnapshot initializes the cache from the snapshot file, unless the
+// snapshot is older than snapshotMaxStaleness. A missing snapshot file is
+// not an error.
+func (f *ElasticsearchFetcher) loadSnapshot() error {
+	b, err := os.ReadFile(f.snapshotPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return fmt.Errorf("invalid agent config snapshot %s: %w", f.snapshotPath, err)
+	}
+	if age := time.Since(snapshot.Timestamp); f.snapshotMaxStaleness > 0 && age > f.snapshotMaxStaleness {
+		f.logger.Info(fmt.Sprintf("ignoring agent config snapshot %s taken %s ago", f.snapshotPath, age.Round(time.Second)))
+		return nil
+	}
+
+	cfgs := make([]AgentConfig, 0, len(snapshot.Configs))
+	for _, cfg := range snapshot.Configs {
+		cfgs = append(cfgs, AgentConfig{
+			Config:             cfg.Settings,
+			ServiceName:        cfg.ServiceName,
+			ServiceEnvironment: cfg.ServiceEnvironment,
+			AgentName:          cfg.AgentName,
+			Etag:               cfg.Etag,
+			ID:                 cfg.ID,
+			AppliedByAgent:     cfg.AppliedByAgent,
+			Instance: Instance{
+				NodeName: cfg.NodeName,
+				HostName: cfg.HostName,
+				Labels:   cfg.Labels,
+			},
+			Rollout: cfg.Rollout,
+		})
+	}
+	index := newAgentConfigIndex(cfgs)
+	f.mu.Lock()
+	f.cache = index
+	f.mu.Unlock()
+	f.cacheInitialized.Store(true)
+	f.watchers.update(index)
+	f.lastRefresh.Store(snapshot.Timestamp.UnixNano())
+	// Force the next refresh to reload the cache, even if Elasticsearch
+	// holds no agent configs.
+	f.lastState = cacheState{count: -1}
+	f.logger.Info(fmt.Sprintf("loaded %d agent configs from snapshot %s", len(cfgs), f.snapshotPath))
+	return nil
+}
@@ -0,0 +1,153 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	fetchResultHit      = "hit"
+	fetchResultMiss     = "miss"
+	fetchResultNotReady = "not_ready"
+)
+
+// statusError is returned when Elasticsearch responds with an error status.
+type statusError struct {
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("refresh cache elasticsearch returned status %d", e.statusCode)
+}
+
+// elasticsearchTelemetry holds the instruments of an ElasticsearchFetcher.
+type elasticsearchTelemetry struct {
+	refreshDuration metric.Float64Histogram
+	refreshFailures metric.Int64Counter
+	fetches         metric.Int64Counter
+	// fetchOptions holds the options recording fetches by result, built
+	// once so that fetches do not allocate.
+	fetchOptions map[string][]metric.AddOption
+	// registration holds the callback observing the cache gauges, it is
+	// unregistered when Run returns.
+	registration metric.Registration
+	// attrs holds the attributes common to all measurements, see
+	// withTelemetryAttributes.
+	attrs []attribute.KeyValue
+}
+
+func (f *ElasticsearchFetcher) newTelemetry(mp metric.MeterProvider) (elasticsearchTelemetry, error) {
+	t := elasticsearchTelemetry{
+		fetchOptions: make(map[string][]metric.AddOption),
+		attrs:        f.telemetryAttrs,
+	}
+	for _, result := range []string{fetchResultHit, fetchResultMiss, fetchResultNotReady} {
+		attrs := append(slices.Clip(t.attrs), attribute.String("result", result))
+		t.fetchOptions[result] = []metric.AddOption{
+			metric.WithAttributeSet(attribute.NewSet(attrs...)),
+		}
+	}
+	meter := mp.Meter(scopeName)
+
+	var errs, err error
+	t.refreshDuration, err = meter.Float64Histogram(
+		"agentcfg.elasticsearch.refresh.duration",
+		metric.WithDescription("Duration of agent config cache refreshes."),
+		metric.WithUnit("s"),
+	)
+	errs = errors.Join(errs, err)
+	t.refreshFailures, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.refresh.failures",
+		metric.WithDescription("Number of failed agent config cache refreshes."),
+		metric.WithUnit("{refresh}"),
+	)
+	errs = errors.Join(errs, err)
+	t.fetches, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.fetches",
+		metric.WithDescription("Number of agent config fetches by result."),
+		metric.WithUnit("{fetch}"),
+	)
+	errs = errors.Join(errs, err)
+
+	cacheAge, err := meter.Float64ObservableGauge(
+		"agentcfg.elasticsearch.cache.age",
+		metric.WithDescription("Time since the last successful agent config cache refresh."),
+		metric.WithUnit("s"),
+	)
+	errs = errors.Join(errs, err)
+	cacheEntries, err := meter.Int64ObservableGauge(
+		"agentcfg.elasticsearch.cache.entries",
+		metric.WithDescription("Number of agent configs in the cache."),
+		metric.WithUnit("{config}"),
+	)
+	errs = errors.Join(errs, err)
+	if errs != nil {
+		return t, errs
+	}
+
+	observeOption := metric.WithAttributes(t.attrs...)
+	t.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		if !f.cacheInitialized.Load() {
+			return nil
+		}
+		last := time.Unix(0, f.lastRefresh.Load())
+		o.ObserveFloat64(cacheAge, time.Since(last).Seconds(), observeOption)
+		f.mu.RLock()
+		o.ObserveInt64(cacheEntries, int64(len(f.cache.cfgs)), observeOption)
+		f.mu.RUnlock()
+		return nil
+	}, cacheAge, cacheEntries)
+	return t, err
+}
+
+// unregister stops observing the cache gauges, so that a fetcher which is
+// no longer running can be garbage collected.
+func (t elasticsearchTelemetry) unregister() error {
+	if t.registration == nil {
+		return nil
+	}
+	return t.registration.Unregister()
+}
+
+func (t elasticsearchTelemetry) recordRefresh(ctx context.Context, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		attrs := slices.Clip(t.attrs)
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			attrs = append(attrs, attribute.Int("http.response.status_code", statusErr.statusCode))
+		}
+		t.refreshFailures.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+	t.refreshDuration.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributes(append(slices.Clip(t.attrs), attribute.String("outcome", outcome))...),
+	)
+}
+
+func (t elasticsearchTelemetry) recordFetch(ctx context.Context, result string) {
+	t.fetches.Add(ctx, 1, t.fetchOptions[result]...)
+}
@@ -0,0 +1,184 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// ErrUnknownTenant is returned when fetching the agent configuration of a
+// tenant a MultiTenantFetcher does not know, or of a query without tenant.
+const ErrUnknownTenant = "unknown agentcfg tenant"
+
+type tenantContextKey struct{}
+
+// ContextWithTenant returns a copy of ctx holding tenant, used by
+// MultiTenantFetcher for queries without Query.Tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant held by ctx, see ContextWithTenant.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok
+}
+
+// TenantConfig configures where the agent configurations of a tenant of a
+// MultiTenantFetcher are stored.
+type TenantConfig struct {
+	Client *elasticsearch.Client
+	// Index holds the name of the index holding the agent configurations
+	// of the tenant. Defaults to ElasticsearchIndexName.
+	Index string
+	// Options holds the options specific to the tenant, e.g. WithSnapshot,
+	// applied after the options common to all tenants.
+	Options []ElasticsearchFetcherOption
+}
+
+// MultiTenantFetcher serves the agent configurations of several tenants,
+// each stored in its own Elasticsearch index, possibly in its own cluster.
+//
+// Every tenant has its own ElasticsearchFetcher, whose cache is refreshed
+// independently: a tenant whose Elasticsearch config is invalid, e.g. whose
+// credentials are rejected with 403 responses, does not affect the others.
+// Logs and metrics of tenant fetchers hold the tenant name.
+//
+// The tenant of a query is Query.Tenant if set, or the tenant of the query
+// context otherwise, see ContextWithTenant.
+type MultiTenantFetcher struct {
+	fetchers map[string]*ElasticsearchFetcher
+}
+
+// NewMultiTenantFetcher returns a MultiTenantFetcher serving the agent
+// configurations of tenants, keyed by tenant name. The options opts apply
+// to the fetchers of all tenants. If opts holds WithSnapshot, the snapshot
+// path of every tenant is suffixed with the tenant name, e.g. agentcfg.json
+// becomes agentcfg-<tenant>.json, so that tenants do not overwrite each
+// other's snapshots.
+func NewMultiTenantFetcher(
+	tenants map[string]TenantConfig,
+	cacheDuration time.Duration,
+	logger *zap.Logger,
+	opts ...ElasticsearchFetcherOption,
+) *MultiTenantFetcher {
+	f := &MultiTenantFetcher{fetchers: make(map[string]*ElasticsearchFetcher, len(tenants))}
+	for name, tenant := range tenants {
+		tenantOpts := append(slices.Clip(opts),
+			withTelemetryAttributes(attribute.String("tenant", name)),
+			withTenantSnapshot(name),
+		)
+		if tenant.Index != "" {
+			tenantOpts = append(tenantOpts, WithIndex(tenant.Index))
+		}
+		tenantOpts = append(tenantOpts, tenant.Options...)
+		f.fetchers[name] = NewElasticsearchFetcher(
+			tenant.Client, cacheDuration, logger.With(zap.String("tenant", name)), tenantOpts...,
+		)
+	}
+	return f
+}
+
+// Tenant returns the fetcher of tenant, or nil if there is none.
+func (f *MultiTenantFetcher) Tenant(tenant string) *ElasticsearchFetcher {
+	return f.fetchers[tenant]
+}
+
+// Fetch finds the agent config of the query tenant matching query.
+func (f *MultiTenantFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	fetcher := f.fetcher(ctx, query)
+	if fetcher == nil {
+		return Result{}, errors.New(ErrUnknownTenant)
+	}
+	return fetcher.Fetch(ctx, query)
+}
+
+// Watch returns a channel receiving the agent config of service of the
+// tenant of ctx whenever it changes. See Watcher. The channel is closed
+// immediately if the tenant is unknown.
+func (f *MultiTenantFetcher) Watch(ctx context.Context, service Service) <-chan Result {
+	fetcher := f.fetcher(ctx, Query{})
+	if fetcher == nil {
+		ch := make(chan Result)
+		close(ch)
+		return ch
+	}
+	return fetcher.Watch(ctx, service)
+}
+
+// Run refreshes the caches of all tenants until ctx is done. A tenant
+// whose fetcher fails does not stop the others, its error is logged and
+// returned once all tenants are done.
+func (f *MultiTenantFetcher) Run(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for name, fetcher := range f.fetchers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fetcher.Run(ctx)
+			if err == nil || errors.Is(err, ctx.Err()) {
+				return
+			}
+			fetcher.logger.Error(fmt.Sprintf("tenant agent config fetcher failed: %s", err))
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("tenant %s: %w", name, err))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return ctx.Err()
+}
+
+// withTenantSnapshot suffixes the snapshot path set by the options common
+// to all tenants with the tenant name.
+func withTenantSnapshot(tenant string) ElasticsearchFetcherOption {
+	return func(f *ElasticsearchFetcher) {
+		if f.snapshotPath == "" {
+			return
+		}
+		ext := filepath.Ext(f.snapshotPath)
+		f.snapshotPath = strings.TrimSuffix(f.snapshotPath, ext) + "-" + tenant + ext
+	}
+}
+
+func (f *MultiTenantFetcher) fetcher(ctx context.Context, query Query) *ElasticsearchFetcher {
+	tenant := query.Tenant
+	if tenant == "" {
+		tenant, _ = TenantFromContext(ctx)
+	}
+	return f.fetchers[tenant]
+}
@@ -18,19 +18,33 @@
 package agentcfg
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata/metricdatatest"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
 
 var sampleHits = []map[string]interface{}{
@@ -51,67 +65,283 @@ func newMockElasticsearchClient(t testing.TB, handler func(http.ResponseWriter,
 	return client
 }
 
-func newElasticsearchFetcher(
-	t testing.TB,
-	hits []map[string]interface{},
-	searchSize int,
-) *ElasticsearchFetcher {
-	maxScore := func(hits []map[string]interface{}) interface{} {
-		if len(hits) == 0 {
-			return nil
-		}
-		return 1
-	}
-	respTmpl := map[string]interface{}{
-		"_scroll_id": "FGluY2x1ZGVfY29udGV4dF91dWlkDXF1ZXJ5QW5kRmV0Y2gBFkJUT0Z5bFUtUXRXM3NTYno0dkM2MlEAAAAAAABnRBY5OUxYalAwUFFoS1NfLV9lWjlSYTRn",
-		"_shards":    map[string]interface{}{"failed": 0, "skipped": 0, "successful": 1, "total": 1},
-		"hits": map[string]interface{}{
-			"hits":      []map[string]interface{}{},
-			"max_score": maxScore(hits),
-			"total":     map[string]interface{}{"relation": "eq", "value": len(hits)},
-		},
-		"timed_out": false,
-		"took":      1,
+// mockAgentConfigIndex emulates the Elasticsearch APIs used to refresh
+// the agent configuration cache, and to write agent configurations.
+type mockAgentConfigIndex struct {
+	t    testing.TB
+	name string
+	hits []map[string]interface{}
+	// openPITs holds the IDs of the points in time not closed yet.
+	openPITs map[string]bool
+	// pitsOpened holds the total number of points in time opened.
+	pitsOpened int
+	// searchStatus, if set, is returned by paginated search requests.
+	searchStatus int
+	// docsIndexed holds the total number of documents indexed.
+	docsIndexed int
+	// seqNo holds the sequence number of the latest write.
+	seqNo int
+	mu    sync.Mutex
+	// strictMapping, if set, rejects writes of documents with fields not
+	// mapped by Kibana, as Kibana does for ElasticsearchIndexName.
+	strictMapping bool
+}
+
+func newMockAgentConfigIndex(t testing.TB, hits []map[string]interface{}) *mockAgentConfigIndex {
+	return &mockAgentConfigIndex{t: t, name: ElasticsearchIndexName, hits: hits, openPITs: make(map[string]bool), strictMapping: true}
+}
+
+// kibanaMappedFields holds the fields of agent configuration documents
+// mapped by Kibana.
+var kibanaMappedFields = []string{"@timestamp", "agent_name", "applied_by_agent", "etag", "service", "service.environment", "service.name", "settings"}
+
+// unmappedField returns the first field of source not mapped by Kibana.
+func unmappedField(source map[string]interface{}, prefix string) (string, bool) {
+	keys := make([]string, 0, len(source))
+	for k := range source {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		field := prefix + k
+		if !slices.Contains(kibanaMappedFields, field) {
+			return field, true
+		}
+		if nested, ok := source[k].(map[string]interface{}); ok && field != "settings" {
+			if field, ok := unmappedField(nested, field+"."); ok {
+				return field, true
+			}
+		}
 	}
+	return "", false
+}
 
-	i := 0
+func (m *mockAgentConfigIndex) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/_search/scroll") {
-			scrollID := strings.TrimPrefix(r.URL.Path, "/_search/scroll/")
-			assert.Equal(t, respTmpl["_scroll_id"], scrollID)
+	var resp interface{}
+	docID, isDoc := strings.CutPrefix(r.URL.Path, "/"+m.name+"/_doc/")
+	if !isDoc {
+		docID = ""
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/"+m.name+"/_search" && hasQuery(m.t, r):
+		var req struct {
+			Query struct {
+				Bool struct {
+					Filter []struct {
+						Term map[string]string `json:"term"`
+					} `json:"filter"`
+					MustNot []struct {
+						Exists struct {
+							Field string `json:"field"`
+						} `json:"exists"`
+					} `json:"must_not"`
+				} `json:"bool"`
+			} `json:"query"`
+			Size int `json:"size"`
+		}
+		require.NoError(m.t, json.NewDecoder(r.Body).Decode(&req))
+		hits := []map[string]interface{}{}
+	hits:
+		for _, hit := range m.hits {
+			source := hit["_source"].(map[string]interface{})
+			for _, filter := range req.Query.Bool.Filter {
+				for field, value := range filter.Term {
+					if v, ok := lookupField(source, field); !ok || v != value {
+						continue hits
+					}
+				}
+			}
+			for _, mustNot := range req.Query.Bool.MustNot {
+				if _, ok := lookupField(source, mustNot.Exists.Field); ok {
+					continue hits
+				}
+			}
+			if len(hits) < req.Size {
+				hits = append(hits, hit)
+			}
+		}
+		resp = map[string]interface{}{"hits": map[string]interface{}{"hits": hits}}
+	case isDoc && r.Method == http.MethodGet:
+		assert.Equal(m.t, "agent_name", r.URL.Query().Get("_source"))
+		i := m.findDoc(docID)
+		if i < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found":false}`))
+			return
+		}
+		source := map[string]interface{}{}
+		if agentName, ok := m.hits[i]["_source"].(map[string]interface{})["agent_name"]; ok {
+			source["agent_name"] = agentName
+		}
+		resp = map[string]interface{}{"_id": docID, "_seq_no": m.hits[i]["_seq_no"], "_primary_term": 1, "found": true, "_source": source}
+	case isDoc && r.Method == http.MethodDelete:
+		assert.Equal(m.t, "true", r.URL.Query().Get("refresh"))
+		i := m.findDoc(docID)
+		if i < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"result":"not_found"}`))
+			return
+		}
+		m.hits = append(m.hits[:i:i], m.hits[i+1:]...)
+		m.seqNo++
+		resp = map[string]interface{}{"_id": docID, "result": "deleted"}
+	case isDoc && r.Method == http.MethodPut || r.Method == http.MethodPost && r.URL.Path == "/"+m.name+"/_doc":
+		assert.Equal(m.t, "true", r.URL.Query().Get("refresh"))
+		var source map[string]interface{}
+		require.NoError(m.t, json.NewDecoder(r.Body).Decode(&source))
+		if field, ok := unmappedField(source, ""); ok && m.strictMapping {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"type":"strict_dynamic_mapping_exception","reason":"mapping set to strict, dynamic introduction of [%s] within [_doc] is not allowed"}}`, field)
+			return
+		}
+		params := r.URL.Query()
+		existing := m.findDoc(docID)
+		if params.Get("op_type") == "create" && existing >= 0 ||
+			params.Has("if_seq_no") && (existing < 0 || params.Get("if_seq_no") != fmt.Sprint(m.hits[existing]["_seq_no"]) || params.Get("if_primary_term") != "1") {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":{"type":"version_conflict_engine_exception"}}`))
 			return
 		}
-		switch r.URL.Path {
-		case "/_search/scroll":
-			scrollID := r.URL.Query().Get("scroll_id")
-			assert.Equal(t, respTmpl["_scroll_id"], scrollID)
-		case "/.apm-agent-configuration/_search":
-		default:
-			assert.Failf(t, "unexpected path", "path: %s", r.URL.Path)
+		m.docsIndexed++
+		if docID == "" {
+			docID = fmt.Sprintf("doc-%d", m.docsIndexed)
 		}
-		if i < len(hits) {
-			respTmpl["hits"].(map[string]interface{})["hits"] = hits[i : i+searchSize]
+		m.seqNo++
+		hit := map[string]interface{}{"_id": docID, "_source": source, "_seq_no": m.seqNo, "_primary_term": 1}
+		if i := m.findDoc(docID); i >= 0 {
+			m.hits = append(m.hits[:i:i], append([]map[string]interface{}{hit}, m.hits[i+1:]...)...)
 		} else {
-			respTmpl["hits"].(map[string]interface{})["hits"] = []map[string]interface{}{}
+			m.hits = append(m.hits[:len(m.hits):len(m.hits)], hit)
+		}
+		resp = map[string]interface{}{"_id": docID, "result": "created"}
+	case r.Method == http.MethodPost && r.URL.Path == "/"+m.name+"/_search":
+		var maxTimestamp interface{}
+		latest := []interface{}{}
+		for _, hit := range m.hits {
+			if ts, ok := hit["_source"].(map[string]interface{})["@timestamp"].(float64); ok {
+				if cur, ok := maxTimestamp.(float64); !ok || ts > cur {
+					maxTimestamp = ts
+				}
+			}
+			if seqNo, ok := hit["_seq_no"].(int); ok && (len(latest) == 0 || seqNo > latest[0].(map[string]interface{})["_seq_no"].(int)) {
+				latest = []interface{}{map[string]interface{}{"_id": hit["_id"], "_seq_no": seqNo, "_primary_term": 1}}
+			}
+		}
+		resp = map[string]interface{}{
+			"hits":         map[string]interface{}{"hits": latest, "total": map[string]interface{}{"relation": "eq", "value": len(m.hits)}},
+			"aggregations": map[string]interface{}{"max_timestamp": map[string]interface{}{"value": maxTimestamp}},
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/"+m.name+"/_pit":
+		assert.Equal(m.t, pitKeepAlive, r.URL.Query().Get("keep_alive"))
+		m.pitsOpened++
+		id := fmt.Sprintf("pit-%d", m.pitsOpened)
+		m.openPITs[id] = true
+		resp = map[string]interface{}{"id": id}
+	case r.Method == http.MethodPost && r.URL.Path == "/_search":
+		if m.searchStatus != 0 {
+			w.WriteHeader(m.searchStatus)
+			return
+		}
+		var req struct {
+			Pit struct {
+				ID string `json:"id"`
+			} `json:"pit"`
+			SearchAfter []int `json:"search_after"`
+			Size        int   `json:"size"`
+		}
+		require.NoError(m.t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(m.t, m.openPITs[req.Pit.ID], "search on unknown point in time %q", req.Pit.ID)
+		from := 0
+		if len(req.SearchAfter) > 0 {
+			from = req.SearchAfter[0] + 1
+		}
+		hits := []map[string]interface{}{}
+		for i := from; i < len(m.hits) && i < from+req.Size; i++ {
+			hit := make(map[string]interface{}, len(m.hits[i])+1)
+			for k, v := range m.hits[i] {
+				hit[k] = v
+			}
+			hit["sort"] = []int{i}
+			hits = append(hits, hit)
 		}
+		resp = map[string]interface{}{
+			"pit_id": req.Pit.ID,
+			"hits":   map[string]interface{}{"hits": hits, "total": map[string]interface{}{"relation": "eq", "value": len(m.hits)}},
+		}
+	case r.Method == http.MethodDelete && r.URL.Path == "/_pit":
+		var req struct {
+			ID string `json:"id"`
+		}
+		require.NoError(m.t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(m.t, m.openPITs[req.ID], "close of unknown point in time %q", req.ID)
+		delete(m.openPITs, req.ID)
+		resp = map[string]interface{}{"succeeded": true, "num_freed": 1}
+	default:
+		assert.Failf(m.t, "unexpected request", "%s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-		b, err := json.Marshal(respTmpl)
-		require.NoError(t, err)
-		w.WriteHeader(200)
-		_, err = w.Write(b)
-		require.NoError(t, err)
-		i += searchSize
-	}), time.Second, zap.NewNop())
-	fetcher.searchSize = searchSize
-	return fetcher
+	b, err := json.Marshal(resp)
+	require.NoError(m.t, err)
+	w.Write(b)
+}
+
+func (m *mockAgentConfigIndex) findDoc(id string) int {
+	for i, hit := range m.hits {
+		if hit["_id"] == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasQuery reports whether the body of the search request r has a query,
+// keeping the body readable.
+func hasQuery(t testing.TB, r *http.Request) bool {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return bytes.Contains(body, []byte(`"query"`))
+}
+
+// lookupField returns the value of the dotted field path in source.
+func lookupField(source map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = source
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func newElasticsearchFetcher(
+	t testing.TB,
+	hits []map[string]interface{},
+	searchSize int,
+) *ElasticsearchFetcher {
+	index := newMockAgentConfigIndex(t, hits)
+	return NewElasticsearchFetcher(
+		newMockElasticsearchClient(t, index.handle),
+		time.Second,
+		zap.NewNop(),
+		WithSearchSize(searchSize),
+	)
 }
 
 func TestFetch(t *testing.T) {
 	fetcher := newElasticsearchFetcher(t, sampleHits, 2)
 	err := fetcher.refreshCache(context.Background())
 	require.NoError(t, err)
-	require.Len(t, fetcher.cache, 2)
+	require.Len(t, fetcher.cache.cfgs, 2)
 
 	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}, Etag: ""})
 	require.NoError(t, err)
@@ -122,13 +352,64 @@ func TestFetch(t *testing.T) {
 	}}, result)
 }
 
-func TestRefreshCacheScroll(t *testing.T) {
-	fetcher := newElasticsearchFetcher(t, sampleHits, 1)
+func TestRefreshCachePagination(t *testing.T) {
+	index := newMockAgentConfigIndex(t, sampleHits)
+	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Second, zap.NewNop(), WithSearchSize(1))
 	err := fetcher.refreshCache(context.Background())
 	require.NoError(t, err)
-	require.Len(t, fetcher.cache, 2)
-	require.Equal(t, "first", fetcher.cache[0].ServiceName)
-	require.Equal(t, "second", fetcher.cache[1].ServiceName)
+	require.Len(t, fetcher.cache.cfgs, 2)
+	require.Equal(t, "first", fetcher.cache.cfgs[0].ServiceName)
+	require.Equal(t, "second", fetcher.cache.cfgs[1].ServiceName)
+	assert.Empty(t, index.openPITs)
+}
+
+func TestRefreshCacheUnchanged(t *testing.T) {
+	index := newMockAgentConfigIndex(t, sampleHits[:1])
+	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Second, zap.NewNop())
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Equal(t, 1, index.pitsOpened)
+	require.Len(t, fetcher.cache.cfgs, 1)
+
+	// Nothing changed, the cache is not reloaded.
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Equal(t, 1, index.pitsOpened)
+
+	index.hits = sampleHits
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Equal(t, 2, index.pitsOpened)
+	require.Len(t, fetcher.cache.cfgs, 2)
+
+	// Deletions are detected even if the latest timestamp does not change.
+	index.hits = sampleHits[:1]
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Equal(t, 3, index.pitsOpened)
+	require.Len(t, fetcher.cache.cfgs, 1)
+
+	// So are modifications not increasing the latest timestamp.
+	modified := maps.Clone(sampleHits[0])
+	modified["_seq_no"] = 1
+	index.hits = []map[string]interface{}{modified}
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Equal(t, 4, index.pitsOpened)
+	assert.Empty(t, index.openPITs)
+}
+
+func TestRefreshCacheInvalidSearchSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		fetcher := newElasticsearchFetcher(t, sampleHits, size)
+		assert.Equal(t, defaultSearchSize, fetcher.searchSize)
+		require.NoError(t, fetcher.refreshCache(context.Background()))
+		assert.Len(t, fetcher.cache.cfgs, 2)
+	}
+}
+
+func TestRefreshCacheClosesPointInTimeOnError(t *testing.T) {
+	index := newMockAgentConfigIndex(t, sampleHits)
+	index.searchStatus = http.StatusServiceUnavailable
+	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Second, zap.NewNop())
+	require.EqualError(t, fetcher.refreshCache(context.Background()), "refresh cache elasticsearch returned status 503")
+	assert.Equal(t, 1, index.pitsOpened)
+	assert.Empty(t, index.openPITs)
 }
 
 func TestFetchOnCacheNotReady(t *testing.T) {
@@ -158,3 +439,806 @@ func TestFetchNoFallback(t *testing.T) {
 	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: ""}, Etag: ""})
 	require.EqualError(t, err, ErrInfrastructureNotReady)
 }
+
+func TestRunRetriesInvalidConfig(t *testing.T) {
+	index := newMockAgentConfigIndex(t, sampleHits)
+	index.searchStatus = http.StatusUnauthorized
+	fetcher := NewElasticsearchFetcher(
+		newMockElasticsearchClient(t, index.handle),
+		time.Hour,
+		zap.NewNop(),
+		WithInvalidConfigRetry(10*time.Millisecond, 50*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fetcher.Run(ctx) }()
+	defer func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+		return err != nil && err.Error() == ErrNoValidElasticsearchConfig
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Refreshes are retried until the credentials are accepted again.
+	index.mu.Lock()
+	index.searchStatus = 0
+	index.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		_, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !fetcher.invalidESCfg.Load() }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestWithInvalidConfigRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		interval, maxInterval time.Duration
+		expectedInterval      time.Duration
+		expectedMaxInterval   time.Duration
+	}{
+		{name: "valid", interval: time.Second, maxInterval: time.Minute, expectedInterval: time.Second, expectedMaxInterval: time.Minute},
+		{name: "zero", expectedInterval: 5 * time.Second, expectedMaxInterval: 5 * time.Minute},
+		{name: "negative", interval: -time.Second, maxInterval: -time.Minute, expectedInterval: 5 * time.Second, expectedMaxInterval: 5 * time.Minute},
+		{name: "max_lower", interval: time.Minute, maxInterval: time.Second, expectedInterval: time.Minute, expectedMaxInterval: time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fetcher := NewElasticsearchFetcher(nil, time.Hour, zap.NewNop(), WithInvalidConfigRetry(tc.interval, tc.maxInterval))
+			assert.Equal(t, tc.expectedInterval, fetcher.retryInterval)
+			assert.Equal(t, tc.expectedMaxInterval, fetcher.maxRetryInterval)
+		})
+	}
+}
+
+func TestSetClient(t *testing.T) {
+	forbidden := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	fetcher := NewElasticsearchFetcher(
+		forbidden,
+		time.Hour,
+		zap.NewNop(),
+		WithInvalidConfigRetry(time.Hour, time.Hour),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fetcher.Run(ctx) }()
+	defer func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	}()
+	assert.Eventually(t, fetcher.invalidESCfg.Load, 10*time.Second, 10*time.Millisecond)
+
+	// Swapping the client refreshes the cache immediately.
+	index := newMockAgentConfigIndex(t, sampleHits)
+	fetcher.SetClient(newMockElasticsearchClient(t, index.handle))
+	assert.Eventually(t, func() bool {
+		_, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !fetcher.invalidESCfg.Load() }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestMultiTenantFetcher(t *testing.T) {
+	indexA := newMockAgentConfigIndex(t, sampleHits[:1])
+	indexA.name = "tenant-a"
+	indexA.searchStatus = http.StatusForbidden
+	indexB := newMockAgentConfigIndex(t, sampleHits[1:])
+	indexB.name = "tenant-b"
+	fetcher := NewMultiTenantFetcher(map[string]TenantConfig{
+		"a": {Client: newMockElasticsearchClient(t, indexA.handle), Index: "tenant-a"},
+		"b": {Client: newMockElasticsearchClient(t, indexB.handle), Index: "tenant-b"},
+	}, time.Hour, zap.NewNop(), WithInvalidConfigRetry(time.Millisecond, time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- fetcher.Run(ctx) }()
+	defer func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	}()
+
+	// Tenant b is served while Elasticsearch rejects the requests of a.
+	assert.Eventually(t, func() bool {
+		_, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "second"}, Tenant: "b"})
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	result, err := fetcher.Fetch(ContextWithTenant(ctx, "b"), Query{Service: Service{Name: "second"}})
+	require.NoError(t, err)
+	assert.Equal(t, "2da2f86251165ccced5c5e41100a216b0c880db4", result.Source.Etag)
+	assert.Eventually(t, fetcher.Tenant("a").invalidESCfg.Load, 10*time.Second, 10*time.Millisecond)
+	_, err = fetcher.Fetch(ContextWithTenant(ctx, "a"), Query{Service: Service{Name: "first"}})
+	assert.EqualError(t, err, ErrNoValidElasticsearchConfig)
+
+	// Tenants do not see each other's configs.
+	result, err = fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}, Tenant: "b"})
+	require.NoError(t, err)
+	assert.Equal(t, zeroResult(), result)
+
+	indexA.mu.Lock()
+	indexA.searchStatus = 0
+	indexA.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		result, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}, Tenant: "a"})
+		return err == nil && result.Source.Etag == "ef12bf5e879c38e931d2894a9c90b2cb1b5fa190"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}, Tenant: "c"})
+	assert.EqualError(t, err, ErrUnknownTenant)
+	_, err = fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+	assert.EqualError(t, err, ErrUnknownTenant)
+}
+
+func TestMultiTenantFetcherSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	indexA := newMockAgentConfigIndex(t, sampleHits[:1])
+	indexB := newMockAgentConfigIndex(t, sampleHits[1:])
+	fetcher := NewMultiTenantFetcher(map[string]TenantConfig{
+		"a": {Client: newMockElasticsearchClient(t, indexA.handle)},
+		"b": {Client: newMockElasticsearchClient(t, indexB.handle)},
+		"c": {
+			Client:  newMockElasticsearchClient(t, indexB.handle),
+			Options: []ElasticsearchFetcherOption{WithSnapshot(filepath.Join(dir, "c.json"), time.Hour)},
+		},
+	}, time.Hour, zap.NewNop(), WithSnapshot(filepath.Join(dir, "agentcfg.json"), time.Hour))
+	for _, tenant := range []string{"a", "b", "c"} {
+		require.NoError(t, fetcher.Tenant(tenant).refreshCache(context.Background()))
+	}
+
+	// Every tenant writes its own snapshot.
+	var names []string
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{"agentcfg-a.json", "agentcfg-b.json", "c.json"}, names)
+
+	unavailable := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	fetcher = NewMultiTenantFetcher(map[string]TenantConfig{
+		"a": {Client: unavailable},
+		"b": {Client: unavailable},
+	}, time.Hour, zap.NewNop(), WithSnapshot(filepath.Join(dir, "agentcfg.json"), time.Hour))
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}, Tenant: "a"})
+	require.NoError(t, err)
+	assert.Equal(t, "ef12bf5e879c38e931d2894a9c90b2cb1b5fa190", result.Source.Etag)
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}, Tenant: "b"})
+	require.NoError(t, err)
+	assert.Equal(t, zeroResult(), result)
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agentcfg.json")
+	query := Query{Service: Service{Name: "first"}}
+	index := newMockAgentConfigIndex(t, sampleHits)
+	fetcher := NewElasticsearchFetcher(
+		newMockElasticsearchClient(t, index.handle),
+		time.Second,
+		zap.NewNop(),
+		WithSnapshot(path, time.Hour),
+	)
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	expected, err := fetcher.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "temporary snapshot files are removed")
+
+	// The snapshot is served until Elasticsearch is available again.
+	unavailable := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	fetcher = NewElasticsearchFetcher(unavailable, time.Second, zap.NewNop(), WithSnapshot(path, time.Hour))
+	result, err := fetcher.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, expected, result)
+	require.Error(t, fetcher.refreshCache(context.Background()))
+	result, err = fetcher.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, expected, result)
+
+	// Stale snapshots are ignored.
+	fetcher = NewElasticsearchFetcher(unavailable, time.Second, zap.NewNop(), WithSnapshot(path, time.Nanosecond))
+	_, err = fetcher.Fetch(context.Background(), query)
+	assert.EqualError(t, err, ErrInfrastructureNotReady)
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agentcfg.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	core, logs := observer.New(zap.WarnLevel)
+	fetcher := NewElasticsearchFetcher(nil, time.Second, zap.New(core), WithSnapshot(path, time.Hour))
+
+	_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	assert.EqualError(t, err, ErrInfrastructureNotReady)
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t,
+		fmt.Sprintf("failed to load agent config snapshot: invalid agent config snapshot %s: unexpected end of JSON input", path),
+		logs.All()[0].Message,
+	)
+}
+
+type auditSinkFunc func(context.Context, []AuditEvent)
+
+func (f auditSinkFunc) Audit(ctx context.Context, events []AuditEvent) {
+	f(ctx, events)
+}
+
+func TestAudit(t *testing.T) {
+	hit := func(id string, timestamp float64, etag string, settings map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"_id": id, "_source": map[string]interface{}{
+			"@timestamp": timestamp,
+			"etag":       etag,
+			"service":    map[string]interface{}{"name": id, "environment": "production"},
+			"settings":   settings,
+		}}
+	}
+	index := newMockAgentConfigIndex(t, []map[string]interface{}{
+		hit("changed", 1, "1", map[string]interface{}{"transaction_sample_rate": "0.1", "capture_body": "all", "log_level": "info"}),
+		hit("removed", 1, "2", map[string]interface{}{"transaction_sample_rate": "0.1"}),
+		hit("unchanged", 1, "3", map[string]interface{}{"transaction_sample_rate": "0.1"}),
+	})
+	var audited [][]AuditEvent
+	core, logs := observer.New(zap.InfoLevel)
+	fetcher := NewElasticsearchFetcher(
+		newMockElasticsearchClient(t, index.handle), time.Second, zap.New(core),
+		WithAuditSink(auditSinkFunc(func(_ context.Context, events []AuditEvent) {
+			audited = append(audited, events)
+		})),
+	)
+
+	// The initial load is not audited.
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	assert.Empty(t, audited)
+
+	index.hits = []map[string]interface{}{
+		hit("added", 2, "4", map[string]interface{}{"transaction_sample_rate": "1"}),
+		hit("changed", 2, "5", map[string]interface{}{"transaction_sample_rate": "0.5", "capture_body": "all", "span_min_duration": "5ms"}),
+		hit("unchanged", 1, "3", map[string]interface{}{"transaction_sample_rate": "0.1"}),
+	}
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	require.Len(t, audited, 1)
+	assert.Equal(t, []AuditEvent{{
+		Service:     Service{Name: "added", Environment: "production"},
+		Type:        AuditEventAdded,
+		ID:          "added",
+		NewEtag:     "4",
+		ChangedKeys: []string{"transaction_sample_rate"},
+	}, {
+		Service:     Service{Name: "changed", Environment: "production"},
+		Type:        AuditEventChanged,
+		ID:          "changed",
+		OldEtag:     "1",
+		NewEtag:     "5",
+		ChangedKeys: []string{"log_level", "span_min_duration", "transaction_sample_rate"},
+	}, {
+		Service:     Service{Name: "removed", Environment: "production"},
+		Type:        AuditEventRemoved,
+		ID:          "removed",
+		OldEtag:     "2",
+		ChangedKeys: []string{"transaction_sample_rate"},
+	}}, audited[0])
+
+	changed := logs.FilterMessage(`agent config changed for service "changed" environment "production"`).All()
+	require.Len(t, changed, 1)
+	assert.Equal(t, map[string]interface{}{
+		"agent_config.id":           "changed",
+		"agent_config.agent_name":   "",
+		"agent_config.changed_keys": []interface{}{"log_level", "span_min_duration", "transaction_sample_rate"},
+		"agent_config.old_etag":     "1",
+		"agent_config.new_etag":     "5",
+	}, changed[0].ContextMap())
+	assert.Equal(t, 1, logs.FilterMessageSnippet("agent config added").Len())
+	assert.Equal(t, 1, logs.FilterMessageSnippet("agent config removed").Len())
+}
+
+func TestAppliedByAgentAck(t *testing.T) {
+	hits := []map[string]interface{}{
+		{"_id": "applied", "_source": map[string]interface{}{"applied_by_agent": true, "etag": "1", "service": map[string]interface{}{"name": "applied"}, "settings": map[string]interface{}{}}},
+		{"_id": "etag", "_source": map[string]interface{}{"applied_by_agent": false, "etag": "2", "service": map[string]interface{}{"name": "etag"}, "settings": map[string]interface{}{}}},
+		{"_id": "marked", "_source": map[string]interface{}{"applied_by_agent": false, "etag": "3", "service": map[string]interface{}{"name": "marked"}, "settings": map[string]interface{}{}}},
+		{"_id": "unapplied", "_source": map[string]interface{}{"applied_by_agent": false, "etag": "4", "service": map[string]interface{}{"name": "unapplied"}, "settings": map[string]interface{}{}}},
+	}
+	fetcher := newElasticsearchFetcher(t, hits, len(hits))
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+
+	var bulkRequests int
+	updated := make(map[string]string)
+	bulkResponse := `{"errors":false,"items":[]}`
+	fetcher.client.Store(newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/.apm-agent-configuration/_bulk", r.URL.Path)
+		bulkRequests++
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var action struct {
+				Update struct {
+					ID string `json:"_id"`
+				} `json:"update"`
+			}
+			var doc struct {
+				Script struct {
+					Params struct {
+						Etag string `json:"etag"`
+					} `json:"params"`
+				} `json:"script"`
+			}
+			require.NoError(t, dec.Decode(&action))
+			require.NoError(t, dec.Decode(&doc))
+			updated[action.Update.ID] = doc.Script.Params.Etag
+		}
+		w.Write([]byte(bulkResponse))
+	}))
+	fetcher.acker = newAppliedByAgentAcker(time.Second)
+
+	for _, query := range []Query{
+		{Service: Service{Name: "applied"}, Etag: "1"},
+		{Service: Service{Name: "etag"}, Etag: "2"},
+		{Service: Service{Name: "etag"}, Etag: "2"},
+		{Service: Service{Name: "marked"}, MarkAsAppliedByAgent: true},
+		{Service: Service{Name: "unapplied"}, Etag: "outdated"},
+	} {
+		_, err := fetcher.Fetch(context.Background(), query)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, fetcher.acker.flush(context.Background(), fetcher.client.Load(), ElasticsearchIndexName))
+	assert.Equal(t, 1, bulkRequests)
+	assert.Equal(t, map[string]string{"etag": "2", "marked": "3"}, updated)
+
+	// Acknowledged configs are not updated again.
+	_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "etag"}, Etag: "2"})
+	require.NoError(t, err)
+	require.NoError(t, fetcher.acker.flush(context.Background(), fetcher.client.Load(), ElasticsearchIndexName))
+	assert.Equal(t, 1, bulkRequests)
+
+	// Failed acknowledgements are retried on the next flush.
+	bulkResponse = `{"errors":true,"items":[{"update":{"_id":"unapplied","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}}]}`
+	clear(updated)
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "unapplied"}, Etag: "4"})
+	require.NoError(t, err)
+	require.EqualError(t, fetcher.acker.flush(context.Background(), fetcher.client.Load(), ElasticsearchIndexName),
+		"failed to update 1 documents, first error: es_rejected_execution_exception: rejected")
+	assert.Equal(t, map[string]string{"unapplied": "4"}, updated)
+
+	bulkResponse = `{"errors":`
+	require.Error(t, fetcher.acker.flush(context.Background(), fetcher.client.Load(), ElasticsearchIndexName))
+	bulkResponse = `{"errors":false,"items":[]}`
+	require.NoError(t, fetcher.acker.flush(context.Background(), fetcher.client.Load(), ElasticsearchIndexName))
+	assert.Equal(t, 4, bulkRequests)
+	assert.Empty(t, fetcher.acker.pending)
+
+	// Acknowledgements of documents modified, deleted or marked as applied
+	// are pruned by cache refreshes.
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "unapplied"}, Etag: "4"})
+	require.NoError(t, err)
+	fetcher.acker.add("deleted", "5")
+	fetcher.acker.prune([]AgentConfig{
+		{ID: "etag", Etag: "2", AppliedByAgent: true},
+		{ID: "marked", Etag: "6"},
+		{ID: "unapplied", Etag: "4"},
+	})
+	assert.Equal(t, map[string]string{"unapplied": "4"}, fetcher.acker.acked)
+	assert.Empty(t, fetcher.acker.pending)
+}
+
+func TestAppliedByAgentAckFlushOnExit(t *testing.T) {
+	hits := []map[string]interface{}{
+		{"_id": "etag", "_source": map[string]interface{}{"applied_by_agent": false, "etag": "1", "service": map[string]interface{}{"name": "etag"}, "settings": map[string]interface{}{}}},
+	}
+	fetcher := newElasticsearchFetcher(t, hits, len(hits))
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	fetcher.acker = newAppliedByAgentAcker(time.Hour)
+	_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "etag"}, Etag: "1"})
+	require.NoError(t, err)
+
+	var bulkRequests int
+	fetcher.client.Store(newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/.apm-agent-configuration/_bulk", r.URL.Path)
+		assert.NoError(t, r.Context().Err())
+		bulkRequests++
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, fetcher.Run(ctx), context.Canceled)
+	assert.Equal(t, 1, bulkRequests)
+	assert.Empty(t, fetcher.acker.pending)
+}
+
+func TestFetchInstance(t *testing.T) {
+	hits := []map[string]interface{}{
+		{"_id": "1", "_source": map[string]interface{}{"etag": "1", "service": map[string]interface{}{"name": "opbeans"}, "settings": map[string]interface{}{"transaction_sample_rate": "0.1"}}},
+		{"_id": "2", "_source": map[string]interface{}{"etag": "2", "service": map[string]interface{}{"name": "opbeans", "node": map[string]interface{}{"name": "opbeans-1"}}, "host": map[string]interface{}{"name": "host-1"}, "labels": map[string]interface{}{"region": "eu"}, "settings": map[string]interface{}{"transaction_sample_rate": "1"}}},
+	}
+	fetcher := newElasticsearchFetcher(t, hits, len(hits))
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+	require.NoError(t, err)
+	assert.Equal(t, "1", result.Source.Etag)
+	result, err = fetcher.Fetch(context.Background(), Query{
+		Service:  Service{Name: "opbeans"},
+		Instance: &Instance{NodeName: "opbeans-1", HostName: "host-1", Labels: map[string]string{"region": "eu"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "2", result.Source.Etag)
+}
+
+func TestFetchRollout(t *testing.T) {
+	rollout := func(id string, percentage float64) map[string]interface{} {
+		return map[string]interface{}{"_id": id, "_source": map[string]interface{}{
+			"etag":     id + "-canary",
+			"service":  map[string]interface{}{"name": id},
+			"settings": map[string]interface{}{"transaction_sample_rate": "0.1"},
+			"rollout": map[string]interface{}{
+				"percentage": percentage,
+				"baseline": map[string]interface{}{
+					"etag":     id + "-baseline",
+					"settings": map[string]interface{}{"transaction_sample_rate": "0.5"},
+				},
+			},
+		}}
+	}
+	hits := []map[string]interface{}{rollout("complete", 100), rollout("none", 0), rollout("invalid", 150)}
+	fetcher := newElasticsearchFetcher(t, hits, len(hits))
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	fetcher.acker = newAppliedByAgentAcker(time.Second)
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "complete"}, Etag: "complete-canary"})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{Settings: Settings{"transaction_sample_rate": "0.1"}, Etag: "complete-canary"}}, result)
+
+	// Only the rolled out settings are acknowledged.
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "none"}, MarkAsAppliedByAgent: true})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{Settings: Settings{"transaction_sample_rate": "0.5"}, Etag: "none-baseline"}}, result)
+	assert.Equal(t, map[string]string{"complete": "complete-canary"}, fetcher.acker.pending)
+
+	// Invalid percentages are not rolled out.
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "invalid"}})
+	require.NoError(t, err)
+	assert.Equal(t, "invalid-baseline", result.Source.Etag)
+}
+
+func TestElasticsearchWriter(t *testing.T) {
+	index := newMockAgentConfigIndex(t, nil)
+	index.name = "agent-configs"
+	index.strictMapping = false
+	client := newMockElasticsearchClient(t, index.handle)
+	writer := NewElasticsearchWriter(client, WithWriterIndex("agent-configs"))
+	writer.now = func() time.Time { return time.UnixMilli(1700000000000) }
+	ctx := context.Background()
+
+	cfg := AgentConfig{
+		ServiceName:        "opbeans",
+		ServiceEnvironment: "production",
+		AgentName:          "java",
+		Config:             map[string]string{"transaction_sample_rate": "0.5"},
+	}
+	created, err := writer.Create(ctx, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, agentConfigDocumentID(cfg), created.ID)
+	assert.Equal(t, intakeEtag(cfg, cfg.Config), created.Etag)
+	assert.Equal(t, map[string]interface{}{
+		"@timestamp":       1.7e12,
+		"applied_by_agent": false,
+		"agent_name":       "java",
+		"etag":             created.Etag,
+		"service":          map[string]interface{}{"name": "opbeans", "environment": "production"},
+		"settings":         map[string]interface{}{"transaction_sample_rate": "0.5"},
+	}, index.hits[0]["_source"])
+
+	_, err = writer.Create(ctx, cfg)
+	require.EqualError(t, err, ErrAgentConfigExists)
+
+	// Configs targeting instances are distinct from the service config.
+	canary := cfg
+	canary.Instance = Instance{NodeName: "opbeans-1", Labels: map[string]string{"region": "eu"}}
+	canary.Config = map[string]string{"transaction_sample_rate": "1"}
+	canary.Rollout = &Rollout{Baseline: map[string]string{"transaction_sample_rate": "0.5"}, Percentage: 100}
+	canary, err = writer.Create(ctx, canary)
+	require.NoError(t, err)
+	assert.NotEqual(t, created.ID, canary.ID)
+	assert.Equal(t, intakeEtag(canary, canary.Rollout.Baseline), canary.Rollout.BaselineEtag)
+
+	// Invalid settings are not written.
+	invalid := cfg
+	invalid.Config = map[string]string{"transaction_sample_rate": "2"}
+	_, err = writer.Update(ctx, invalid)
+	require.EqualError(t, err, `setting "transaction_sample_rate": value 2 is greater than 1`)
+	assert.Equal(t, 2, index.docsIndexed)
+
+	updated := cfg
+	updated.Config = map[string]string{"transaction_sample_rate": "0.1"}
+	updated, err = writer.Update(ctx, updated)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, updated.ID)
+	assert.NotEqual(t, created.Etag, updated.Etag)
+
+	// Written configs are served by fetchers.
+	fetcher := NewElasticsearchFetcher(client, time.Second, zap.NewNop(), WithIndex("agent-configs"))
+	require.NoError(t, fetcher.refreshCache(ctx))
+	result, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "opbeans", Environment: "production"}})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{
+		Settings: Settings{"transaction_sample_rate": "0.1"},
+		Etag:     updated.Etag,
+		Agent:    "java",
+	}}, result)
+	result, err = fetcher.Fetch(ctx, Query{
+		Service:  Service{Name: "opbeans", Environment: "production"},
+		Instance: &Instance{NodeName: "opbeans-1", Labels: map[string]string{"region": "eu"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, canary.Etag, result.Source.Etag)
+
+	_, err = writer.Update(ctx, AgentConfig{ID: "unknown", ServiceName: "opbeans"})
+	require.EqualError(t, err, ErrAgentConfigNotFound)
+
+	// Configs for other agents are distinct from the service config.
+	otel := cfg
+	otel.AgentName = "opentelemetry/java"
+	otel, err = writer.Create(ctx, otel)
+	require.NoError(t, err)
+	assert.NotEqual(t, updated.ID, otel.ID)
+	require.EqualError(t, writer.Delete(ctx, AgentConfig{ServiceName: "opbeans", ServiceEnvironment: "production"}), ErrAgentConfigAmbiguous)
+
+	require.NoError(t, writer.Delete(ctx, AgentConfig{ServiceName: "opbeans", ServiceEnvironment: "production", AgentName: "java"}))
+	require.EqualError(t, writer.Delete(ctx, AgentConfig{ServiceName: "opbeans", ServiceEnvironment: "production", AgentName: "java"}), ErrAgentConfigNotFound)
+	require.EqualError(t, writer.Delete(ctx, AgentConfig{ID: created.ID}), ErrAgentConfigNotFound)
+	require.NoError(t, writer.Delete(ctx, AgentConfig{ID: canary.ID}))
+	require.NoError(t, writer.Delete(ctx, otel))
+	assert.Empty(t, index.hits)
+}
+
+func TestElasticsearchWriterKibanaAgentName(t *testing.T) {
+	// Kibana records the agent name of the service in the configs it creates.
+	index := newMockAgentConfigIndex(t, []map[string]interface{}{
+		{"_id": "kibana-1", "_seq_no": 0, "_primary_term": 1, "_source": map[string]interface{}{
+			"@timestamp": 1.7e12, "applied_by_agent": false, "agent_name": "java", "etag": "abc",
+			"service":  map[string]interface{}{"name": "opbeans", "environment": "production"},
+			"settings": map[string]interface{}{"transaction_sample_rate": "0.5"},
+		}},
+	})
+	writer := NewElasticsearchWriter(newMockElasticsearchClient(t, index.handle))
+	ctx := context.Background()
+
+	// Configs without agent name match it.
+	cfg := AgentConfig{ServiceName: "opbeans", ServiceEnvironment: "production", Config: map[string]string{"transaction_sample_rate": "0.1"}}
+	_, err := writer.Create(ctx, cfg)
+	require.EqualError(t, err, ErrAgentConfigExists)
+	updated, err := writer.Update(ctx, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "kibana-1", updated.ID)
+	assert.Equal(t, "java", updated.AgentName)
+	require.Len(t, index.hits, 1)
+	updated, err = writer.Update(ctx, AgentConfig{ID: "kibana-1", ServiceName: "opbeans", ServiceEnvironment: "production"})
+	require.NoError(t, err)
+	assert.Equal(t, "java", updated.AgentName)
+
+	// Configs for other agents do not.
+	otel := cfg
+	otel.AgentName = "opentelemetry/java"
+	otel, err = writer.Create(ctx, otel)
+	require.NoError(t, err)
+	_, err = writer.Update(ctx, cfg)
+	require.EqualError(t, err, ErrAgentConfigAmbiguous)
+	require.NoError(t, writer.Delete(ctx, otel))
+	require.NoError(t, writer.Delete(ctx, cfg))
+	assert.Empty(t, index.hits)
+}
+
+func TestElasticsearchWriterConflicts(t *testing.T) {
+	index := newMockAgentConfigIndex(t, nil)
+	client := newMockElasticsearchClient(t, index.handle)
+	writer := NewElasticsearchWriter(client)
+	ctx := context.Background()
+
+	cfg := AgentConfig{ServiceName: "opbeans", Config: map[string]string{"transaction_sample_rate": "0.5"}}
+	created, err := writer.Create(ctx, cfg)
+	require.NoError(t, err)
+
+	// Creations racing with the lookup of existing configs conflict.
+	cfg.ID = agentConfigDocumentID(cfg)
+	_, err = writer.write(ctx, cfg, esapi.IndexRequest{OpType: "create"}, ErrAgentConfigExists)
+	require.EqualError(t, err, ErrAgentConfigExists)
+
+	// Updates of configs modified since their lookup conflict.
+	existing, err := writer.get(ctx, created.ID)
+	require.NoError(t, err)
+	_, err = writer.Update(ctx, created)
+	require.NoError(t, err)
+	_, err = writer.write(ctx, created, esapi.IndexRequest{
+		IfSeqNo:       &existing.SeqNo,
+		IfPrimaryTerm: &existing.PrimaryTerm,
+	}, ErrAgentConfigModified)
+	require.EqualError(t, err, ErrAgentConfigModified)
+	assert.Equal(t, 2, index.docsIndexed)
+}
+
+func TestElasticsearchWriterKibanaMapping(t *testing.T) {
+	index := newMockAgentConfigIndex(t, nil)
+	writer := NewElasticsearchWriter(newMockElasticsearchClient(t, index.handle))
+	ctx := context.Background()
+
+	// Service configs only hold fields mapped by Kibana.
+	cfg := AgentConfig{ServiceName: "opbeans", ServiceEnvironment: "production", AgentName: "java", Config: map[string]string{"transaction_sample_rate": "0.5"}}
+	_, err := writer.Create(ctx, cfg)
+	require.NoError(t, err)
+
+	// Configs targeting instances and rollouts require an index mapping
+	// their fields.
+	for _, other := range []AgentConfig{
+		{ServiceName: "opbeans", Instance: Instance{NodeName: "opbeans-1"}},
+		{ServiceName: "opbeans", Instance: Instance{HostName: "host-1"}},
+		{ServiceName: "opbeans", Instance: Instance{Labels: map[string]string{"region": "eu"}}},
+		{ServiceName: "opbeans", Rollout: &Rollout{Percentage: 50}},
+	} {
+		_, err := writer.Create(ctx, other)
+		assert.ErrorContains(t, err, "strict_dynamic_mapping_exception")
+	}
+	assert.Equal(t, 1, index.docsIndexed)
+}
+
+func TestIntakeEtag(t *testing.T) {
+	cfg := AgentConfig{ServiceName: "opbeans", Config: map[string]string{"transaction_sample_rate": "0.5", "capture_body": "all"}}
+	etag := intakeEtag(cfg, cfg.Config)
+	// Etags of unchanged configurations must not change across versions,
+	// or agents would reapply them.
+	assert.Equal(t, "cb31a9a9d73ab544529dc880778a076a2630829c", etag)
+	assert.Equal(t, etag, intakeEtag(cfg, map[string]string{"capture_body": "all", "transaction_sample_rate": "0.5"}))
+
+	for _, other := range []AgentConfig{
+		{ServiceName: "opbeans", ServiceEnvironment: "production", Config: cfg.Config},
+		{ServiceName: "opbeans", AgentName: "java", Config: cfg.Config},
+		{ServiceName: "opbeans", Instance: Instance{HostName: "host-1"}, Config: cfg.Config},
+		{ServiceName: "opbeans", Config: map[string]string{"transaction_sample_rate": "0.5"}},
+		{ServiceName: "opbeanß", Config: cfg.Config},
+	} {
+		assert.NotEqual(t, etag, intakeEtag(other, other.Config))
+	}
+}
+
+func TestFetchInsecureAgents(t *testing.T) {
+	hits := []map[string]interface{}{
+		{"_id": "1", "_source": map[string]interface{}{"etag": "1", "agent_name": "rum-js", "service": map[string]interface{}{"name": "frontend"}, "settings": map[string]interface{}{"transaction_sample_rate": "0.1", "capture_body": "all", "log_level": "debug"}}},
+	}
+	query := Query{Service: Service{Name: "frontend"}, InsecureAgents: []string{"rum-js", "js-base"}}
+
+	fetcher := newElasticsearchFetcher(t, hits, 1)
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+	result, err := fetcher.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{
+		Settings: Settings{"transaction_sample_rate": "0.1"},
+		Etag:     "1",
+		Agent:    "rum-js",
+	}}, result)
+
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "frontend"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.1", "capture_body": "all", "log_level": "debug"}, result.Source.Settings)
+}
+
+func TestElasticsearchFetcherTelemetry(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	index := newMockAgentConfigIndex(t, sampleHits)
+	fetcher := NewElasticsearchFetcher(
+		newMockElasticsearchClient(t, index.handle), time.Second, zap.NewNop(),
+		WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+	)
+
+	_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.EqualError(t, err, ErrInfrastructureNotReady)
+
+	index.searchStatus = http.StatusForbidden
+	require.Error(t, fetcher.refreshCache(context.Background()))
+	index.searchStatus = 0
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "unknown"}})
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	metrics := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "agentcfg.elasticsearch.fetches",
+		Description: "Number of agent config fetches by result.",
+		Unit:        "{fetch}",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attribute.NewSet(attribute.String("result", "not_ready")), Value: 1},
+				{Attributes: attribute.NewSet(attribute.String("result", "hit")), Value: 1},
+				{Attributes: attribute.NewSet(attribute.String("result", "miss")), Value: 1},
+			},
+		},
+	}, metrics["agentcfg.elasticsearch.fetches"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "agentcfg.elasticsearch.refresh.failures",
+		Description: "Number of failed agent config cache refreshes.",
+		Unit:        "{refresh}",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attribute.NewSet(attribute.Int("http.response.status_code", http.StatusForbidden)), Value: 1},
+			},
+		},
+	}, metrics["agentcfg.elasticsearch.refresh.failures"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "agentcfg.elasticsearch.cache.entries",
+		Description: "Number of agent configs in the cache.",
+		Unit:        "{config}",
+		Data: metricdata.Gauge[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{{Value: 2}},
+		},
+	}, metrics["agentcfg.elasticsearch.cache.entries"], metricdatatest.IgnoreTimestamp())
+
+	refreshDuration := metrics["agentcfg.elasticsearch.refresh.duration"].Data.(metricdata.Histogram[float64])
+	require.Len(t, refreshDuration.DataPoints, 2)
+	cacheAge := metrics["agentcfg.elasticsearch.cache.age"].Data.(metricdata.Gauge[float64])
+	require.Len(t, cacheAge.DataPoints, 1)
+	assert.Less(t, cacheAge.DataPoints[0].Value, time.Minute.Seconds())
+
+	// The cache gauges are no longer observed once Run returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, fetcher.Run(ctx), context.Canceled)
+	rm = metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		assert.NotContains(t, []string{"agentcfg.elasticsearch.cache.age", "agentcfg.elasticsearch.cache.entries"}, m.Name)
+	}
+}
+
+func newInitializedElasticsearchFetcher(cfgs []AgentConfig) *ElasticsearchFetcher {
+	fetcher := NewElasticsearchFetcher(nil, time.Second, zap.NewNop())
+	fetcher.cache = newAgentConfigIndex(cfgs)
+	fetcher.cacheInitialized.Store(true)
+	return fetcher
+}
+
+func TestFetchDoesNotAllocate(t *testing.T) {
+	fetcher := newInitializedElasticsearchFetcher(newBenchmarkAgentConfigs(1000))
+	query := Query{Service: Service{Name: "service-500", Environment: "production"}}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := fetcher.Fetch(context.Background(), query); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkFetch(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		fetcher := newInitializedElasticsearchFetcher(newBenchmarkAgentConfigs(n))
+		query := Query{Service: Service{Name: fmt.Sprintf("service-%d", n/2), Environment: "production"}}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fetcher.Fetch(context.Background(), query); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
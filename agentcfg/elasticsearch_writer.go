@@ -0,0 +1,518 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf16"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+const (
+	// ErrAgentConfigExists is returned when creating an agent configuration
+	// for a service and instance which already have one.
+	ErrAgentConfigExists = "agent config already exists"
+
+	// ErrAgentConfigNotFound is returned when updating or deleting an
+	// agent configuration which does not exist.
+	ErrAgentConfigNotFound = "agent config not found"
+
+	// ErrAgentConfigModified is returned when updating an agent
+	// configuration which was modified or deleted concurrently.
+	ErrAgentConfigModified = "agent config was modified concurrently"
+
+	// ErrAgentConfigAmbiguous is returned when looking up the agent
+	// configuration of a service and instance without agent name, while
+	// several agent configurations for distinct agents match.
+	ErrAgentConfigAmbiguous = "several agent configs for distinct agents match, agent name is required"
+)
+
+// maxWriterCandidates limits the number of documents of a service searched
+// when looking up the agent configuration of a service and instance.
+const maxWriterCandidates = 100
+
+// ElasticsearchWriter creates, updates and deletes agent configurations in
+// the ElasticsearchIndexName index by default, without going through Kibana.
+//
+// A service has at most one agent configuration per agent name, or one per
+// agent name and instance for agent configurations targeting instances.
+// Kibana records the agent name of the service as metadata of the agent
+// configurations it creates, so agent configurations without agent name
+// match those of any agent name when looked up, as long as a single one
+// matches. Etags are derived from the service, agent name, instance and
+// settings of agent configurations, see intakeEtag, and documents are
+// written with a refresh, so that they are visible to fetchers immediately.
+//
+// Created documents have an ID derived from the service, agent name and
+// instance of the agent configuration, so that concurrent creations of the
+// same agent configuration conflict, and updates only succeed if the document
+// was not modified since it was looked up. Configurations created by Kibana
+// concurrently are not detected.
+//
+// Configurations targeting instances and rollouts are stored in the
+// service.node.name, host.name, labels and rollout fields, which Kibana does
+// not map: as Kibana creates ElasticsearchIndexName with a strict mapping,
+// writing them fails unless the index maps them. Such configurations are
+// usually written to an index of their own, see WithWriterIndex.
+type ElasticsearchWriter struct {
+	client *elasticsearch.Client
+	now    func() time.Time
+	index  string
+}
+
+// ElasticsearchWriterOption configures an ElasticsearchWriter.
+type ElasticsearchWriterOption func(*ElasticsearchWriter)
+
+// WithWriterIndex sets the index agent configurations are written to, e.g.
+// the index of a tenant. Defaults to ElasticsearchIndexName.
+func WithWriterIndex(index string) ElasticsearchWriterOption {
+	return func(w *ElasticsearchWriter) {
+		w.index = index
+	}
+}
+
+// NewElasticsearchWriter returns an ElasticsearchWriter writing agent
+// configurations with client.
+func NewElasticsearchWriter(client *elasticsearch.Client, opts ...ElasticsearchWriterOption) *ElasticsearchWriter {
+	w := &ElasticsearchWriter{
+		client: client,
+		now:    time.Now,
+		index:  ElasticsearchIndexName,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Create creates the agent configuration cfg, returning it with the ID and
+// etag of the created document. The ID of cfg is ignored.
+func (w *ElasticsearchWriter) Create(ctx context.Context, cfg AgentConfig) (AgentConfig, error) {
+	if err := validateAgentConfig(cfg); err != nil {
+		return AgentConfig{}, err
+	}
+	existing, err := w.find(ctx, cfg)
+	if err != nil {
+		return AgentConfig{}, err
+	}
+	if existing != nil {
+		return AgentConfig{}, errors.New(ErrAgentConfigExists)
+	}
+	cfg.ID = agentConfigDocumentID(cfg)
+	return w.write(ctx, cfg, esapi.IndexRequest{OpType: "create"}, ErrAgentConfigExists)
+}
+
+// Update replaces the agent configuration identified by the ID of cfg or,
+// if cfg has no ID, by its service, agent name and instance. If cfg has no
+// agent name, the agent name of the replaced configuration is kept. The
+// updated configuration is returned with its new etag.
+func (w *ElasticsearchWriter) Update(ctx context.Context, cfg AgentConfig) (AgentConfig, error) {
+	if err := validateAgentConfig(cfg); err != nil {
+		return AgentConfig{}, err
+	}
+	var existing *writerHit
+	var err error
+	if cfg.ID == "" {
+		existing, err = w.find(ctx, cfg)
+	} else {
+		existing, err = w.get(ctx, cfg.ID)
+	}
+	if err != nil {
+		return AgentConfig{}, err
+	}
+	if existing == nil {
+		return AgentConfig{}, errors.New(ErrAgentConfigNotFound)
+	}
+	cfg.ID = existing.ID
+	if cfg.AgentName == "" {
+		cfg.AgentName = existing.Source.AgentName
+	}
+	return w.write(ctx, cfg, esapi.IndexRequest{
+		IfSeqNo:       &existing.SeqNo,
+		IfPrimaryTerm: &existing.PrimaryTerm,
+	}, ErrAgentConfigModified)
+}
+
+// Delete deletes the agent configuration identified by the ID of cfg or,
+// if cfg has no ID, by its service and instance.
+func (w *ElasticsearchWriter) Delete(ctx context.Context, cfg AgentConfig) error {
+	if cfg.ID == "" {
+		existing, err := w.find(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errors.New(ErrAgentConfigNotFound)
+		}
+		cfg.ID = existing.ID
+	}
+	resp, err := esapi.DeleteRequest{
+		Index:      w.index,
+		DocumentID: cfg.ID,
+		Refresh:    "true",
+	}.Do(ctx, w.client)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.New(ErrAgentConfigNotFound)
+	}
+	return checkWriterResponse(resp)
+}
+
+// writerHit is an agent configuration document, with the sequence number
+// and primary term of its last write.
+type writerHit struct {
+	cacheHit
+	SeqNo       int `json:"_seq_no"`
+	PrimaryTerm int `json:"_primary_term"`
+}
+
+// find returns the agent configuration with the service, agent name and
+// instance of cfg, or nil if there is none. Unset attributes only match
+// documents without them, as in Kibana, except the agent name: without
+// agent name, the agent configuration without agent name or else the
+// single agent configuration of any agent name is returned.
+func (w *ElasticsearchWriter) find(ctx context.Context, cfg AgentConfig) (*writerHit, error) {
+	var filter, mustNot []interface{}
+	if cfg.AgentName != "" {
+		filter = append(filter, map[string]interface{}{"term": map[string]string{"agent_name": cfg.AgentName}})
+	}
+	for _, field := range []struct{ name, value string }{
+		{"service.name", cfg.ServiceName},
+		{"service.environment", cfg.ServiceEnvironment},
+		{"service.node.name", cfg.Instance.NodeName},
+		{"host.name", cfg.Instance.HostName},
+	} {
+		if field.value == "" {
+			mustNot = append(mustNot, map[string]interface{}{"exists": map[string]string{"field": field.name}})
+		} else {
+			filter = append(filter, map[string]interface{}{"term": map[string]string{field.name: field.value}})
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"size":                maxWriterCandidates,
+		"seq_no_primary_term": true,
+		"query": map[string]interface{}{"bool": map[string]interface{}{
+			"filter":   filter,
+			"must_not": mustNot,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := esapi.SearchRequest{
+		Index: []string{w.index},
+		Body:  bytes.NewReader(body),
+	}.Do(ctx, w.client)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkWriterResponse(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		Hits struct {
+			Hits []writerHit `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	// Labels cannot be matched exactly by a query.
+	var found *writerHit
+	for i, hit := range result.Hits.Hits {
+		if !maps.Equal(hit.Source.Labels, cfg.Instance.Labels) {
+			continue
+		}
+		if hit.Source.AgentName == cfg.AgentName {
+			return &result.Hits.Hits[i], nil
+		}
+		if found != nil {
+			return nil, errors.New(ErrAgentConfigAmbiguous)
+		}
+		found = &result.Hits.Hits[i]
+	}
+	return found, nil
+}
+
+// get returns the agent configuration document with the given ID, with
+// only the agent name of its source, or nil if there is none.
+func (w *ElasticsearchWriter) get(ctx context.Context, id string) (*writerHit, error) {
+	resp, err := esapi.GetRequest{
+		Index:      w.index,
+		DocumentID: id,
+		Source:     []string{"agent_name"},
+	}.Do(ctx, w.client)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkWriterResponse(resp); err != nil {
+		return nil, err
+	}
+	var hit writerHit
+	if err := json.NewDecoder(resp.Body).Decode(&hit); err != nil {
+		return nil, err
+	}
+	return &hit, nil
+}
+
+// write indexes cfg with the document ID and concurrency control of req,
+// returning conflictErr if Elasticsearch reports a version conflict.
+func (w *ElasticsearchWriter) write(ctx context.Context, cfg AgentConfig, req esapi.IndexRequest, conflictErr string) (AgentConfig, error) {
+	cfg.Etag = intakeEtag(cfg, cfg.Config)
+	cfg.AppliedByAgent = false
+	if cfg.Rollout != nil {
+		rollout := *cfg.Rollout
+		rollout.BaselineEtag = intakeEtag(cfg, rollout.Baseline)
+		cfg.Rollout = &rollout
+	}
+
+	body, err := json.Marshal(newAgentConfigDocument(cfg, w.now()))
+	if err != nil {
+		return AgentConfig{}, err
+	}
+	req.Index = w.index
+	req.DocumentID = cfg.ID
+	req.Body = bytes.NewReader(body)
+	req.Refresh = "true"
+	resp, err := req.Do(ctx, w.client)
+	if err != nil {
+		return AgentConfig{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return AgentConfig{}, errors.New(conflictErr)
+	}
+	if err := checkWriterResponse(resp); err != nil {
+		return AgentConfig{}, err
+	}
+	return cfg, nil
+}
+
+// agentConfigDocumentID returns the ID of the document created for cfg,
+// which only depends on its service, agent name and instance.
+func agentConfigDocumentID(cfg AgentConfig) string {
+	return intakeEtag(cfg, nil)
+}
+
+// newAgentConfigDocument returns the document of cfg, in the format read
+// by ElasticsearchFetcher.
+func newAgentConfigDocument(cfg AgentConfig, now time.Time) map[string]interface{} {
+	service := map[string]interface{}{}
+	if cfg.ServiceName != "" {
+		service["name"] = cfg.ServiceName
+	}
+	if cfg.ServiceEnvironment != "" {
+		service["environment"] = cfg.ServiceEnvironment
+	}
+	if cfg.Instance.NodeName != "" {
+		service["node"] = map[string]string{"name": cfg.Instance.NodeName}
+	}
+	doc := map[string]interface{}{
+		"@timestamp":       now.UnixMilli(),
+		"applied_by_agent": false,
+		"etag":             cfg.Etag,
+		"service":          service,
+		"settings":         nonNilSettings(cfg.Config),
+	}
+	if cfg.AgentName != "" {
+		doc["agent_name"] = cfg.AgentName
+	}
+	if cfg.Instance.HostName != "" {
+		doc["host"] = map[string]string{"name": cfg.Instance.HostName}
+	}
+	if len(cfg.Instance.Labels) > 0 {
+		doc["labels"] = cfg.Instance.Labels
+	}
+	if cfg.Rollout != nil {
+		doc["rollout"] = map[string]interface{}{
+			"percentage": cfg.Rollout.Percentage,
+			"baseline": map[string]interface{}{
+				"etag":     cfg.Rollout.BaselineEtag,
+				"settings": nonNilSettings(cfg.Rollout.Baseline),
+			},
+		}
+	}
+	return doc
+}
+
+func nonNilSettings(settings map[string]string) map[string]string {
+	if settings == nil {
+		return map[string]string{}
+	}
+	return settings
+}
+
+// validateAgentConfig returns an error describing the invalid settings and
+// rollout of cfg, if any.
+func validateAgentConfig(cfg AgentConfig) error {
+	var errs []error
+	for _, key := range sortedKeys(cfg.Config) {
+		if err := validateSetting(cfg.AgentName, key, cfg.Config[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.Rollout != nil {
+		for _, key := range sortedKeys(cfg.Rollout.Baseline) {
+			if err := validateSetting(cfg.AgentName, key, cfg.Rollout.Baseline[key]); err != nil {
+				errs = append(errs, fmt.Errorf("rollout baseline: %w", err))
+			}
+		}
+		if p := cfg.Rollout.Percentage; !(p >= 0 && p <= 100) {
+			errs = append(errs, fmt.Errorf("rollout percentage %g is not between 0 and 100", p))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkWriterResponse(resp *esapi.Response) error {
+	if !resp.IsError() {
+		return nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("elasticsearch returned status %d: %s", resp.StatusCode, body)
+}
+
+// intakeEtag computes the etag of cfg with the given settings: the hex
+// encoded SHA-1 digest of the object-hash serialization of the agent
+// configuration intake, modelled on the one of Kibana. The intake holds the
+// service, agent name and settings of cfg, and the instance attributes it
+// targets, if any. Etags are not guaranteed to match those Kibana computes
+// for the same configuration, they only change when the configuration does.
+func intakeEtag(cfg AgentConfig, settings map[string]string) string {
+	service := objectHashObject{}
+	if cfg.ServiceName != "" {
+		service["name"] = cfg.ServiceName
+	}
+	if cfg.ServiceEnvironment != "" {
+		service["environment"] = cfg.ServiceEnvironment
+	}
+	if cfg.Instance.NodeName != "" {
+		service["node"] = objectHashObject{"name": cfg.Instance.NodeName}
+	}
+	intake := objectHashObject{
+		"service":  service,
+		"settings": objectHashStrings(settings),
+	}
+	if cfg.AgentName != "" {
+		intake["agent_name"] = cfg.AgentName
+	}
+	if cfg.Instance.HostName != "" {
+		intake["host"] = objectHashObject{"name": cfg.Instance.HostName}
+	}
+	if len(cfg.Instance.Labels) > 0 {
+		intake["labels"] = objectHashStrings(cfg.Instance.Labels)
+	}
+
+	h := sha1.New()
+	writeObjectHash(h, intake, true)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// objectHashObject is a plain JavaScript object of strings and nested
+// objects.
+type objectHashObject map[string]interface{}
+
+func objectHashStrings(m map[string]string) objectHashObject {
+	o := make(objectHashObject, len(m))
+	for k, v := range m {
+		o[k] = v
+	}
+	return o
+}
+
+// objectHashObjectConstructor is the serialization of the Object function,
+// the constructor of plain objects, which the object-hash package prefixes
+// with the serialization of its properties, or a reference to it.
+const objectHashObjectConstructor = "fn:string:8:[native]string:20:function-name:Object"
+
+// writeObjectHash writes the object-hash serialization of the plain object
+// o to h. Objects are serialized with their prototype, which is only
+// serialized in full the first time, for the top level object, and
+// referenced afterwards.
+func writeObjectHash(h hash.Hash, o objectHashObject, top bool) {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	io.WriteString(h, "object:"+strconv.Itoa(len(keys)+3)+":")
+	writeObjectHashString(h, "prototype")
+	io.WriteString(h, ":Undefined,")
+	writeObjectHashString(h, "__proto__")
+	io.WriteString(h, ":")
+	if top {
+		// Object.prototype, seen second after o.
+		io.WriteString(h, "object:3:")
+		writeObjectHashString(h, "prototype")
+		io.WriteString(h, ":Undefined,")
+		writeObjectHashString(h, "__proto__")
+		io.WriteString(h, ":Null,")
+		writeObjectHashString(h, "constructor")
+		// Object, seen third, has no enumerable properties.
+		io.WriteString(h, ":"+objectHashObjectConstructor+"object:0:,")
+	} else {
+		writeObjectHashString(h, "[CIRCULAR:1]")
+	}
+	io.WriteString(h, ",")
+	writeObjectHashString(h, "constructor")
+	io.WriteString(h, ":"+objectHashObjectConstructor)
+	writeObjectHashString(h, "[CIRCULAR:2]")
+	io.WriteString(h, ",")
+
+	for _, k := range keys {
+		writeObjectHashString(h, k)
+		io.WriteString(h, ":")
+		switch v := o[k].(type) {
+		case string:
+			writeObjectHashString(h, v)
+		case objectHashObject:
+			writeObjectHash(h, v, false)
+		}
+		io.WriteString(h, ",")
+	}
+}
+
+// writeObjectHashString writes the object-hash serialization of s, whose
+// length is the number of UTF-16 code units of s, as in JavaScript.
+func writeObjectHashString(h hash.Hash, s string) {
+	io.WriteString(h, "string:"+strconv.Itoa(len(utf16.Encode([]rune(s))))+":"+s)
+}
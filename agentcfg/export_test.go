@@ -0,0 +1,47 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// NewMockElasticsearchFetcher returns an ElasticsearchFetcher querying a
+// mock Elasticsearch holding cfgs. The cache is not initialized.
+func NewMockElasticsearchFetcher(t testing.TB, cfgs []AgentConfig) *ElasticsearchFetcher {
+	hits := make([]map[string]interface{}, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		// Round trip the documents, as the mock expects decoded JSON.
+		b, err := json.Marshal(newAgentConfigDocument(cfg, time.Now()))
+		require.NoError(t, err)
+		var source map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &source))
+		hits = append(hits, map[string]interface{}{"_id": fmt.Sprint(i), "_source": source})
+	}
+	index := newMockAgentConfigIndex(t, hits)
+	return NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Hour, zap.NewNop())
+}
+
+// RefreshCache refreshes the cache of f once.
+var RefreshCache = (*ElasticsearchFetcher).refreshCache
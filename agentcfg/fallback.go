@@ -0,0 +1,129 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/zap"
+)
+
+const scopeName = "github.com/elastic/opentelemetry-lib/agentcfg"
+
+const (
+	sourcePrimary  = "primary"
+	sourceFallback = "fallback"
+)
+
+// FallbackFetcher serves agent configuration from a primary Fetcher, and
+// falls back to a secondary Fetcher while the primary is not ready or is
+// not properly configured, e.g. during the cold start of an
+// ElasticsearchFetcher or when its credentials are invalid.
+type FallbackFetcher struct {
+	primary       Fetcher
+	fallback      Fetcher
+	logger        *zap.Logger
+	meterProvider metric.MeterProvider
+	fetches       metric.Int64Counter
+	lastSource    atomic.Value
+}
+
+// FallbackFetcherOption configures a FallbackFetcher.
+type FallbackFetcherOption func(*FallbackFetcher)
+
+// WithFallbackMeterProvider sets the meter provider used to report the
+// number of fetches per answering source, in the agentcfg.fallback.fetches
+// metric.
+func WithFallbackMeterProvider(mp metric.MeterProvider) FallbackFetcherOption {
+	return func(f *FallbackFetcher) {
+		f.meterProvider = mp
+	}
+}
+
+// NewFallbackFetcher returns a FallbackFetcher trying primary first and
+// fallback second.
+func NewFallbackFetcher(primary, fallback Fetcher, logger *zap.Logger, opts ...FallbackFetcherOption) *FallbackFetcher {
+	f := &FallbackFetcher{
+		primary:       primary,
+		fallback:      fallback,
+		logger:        logger,
+		meterProvider: noop.NewMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	fetches, err := newFallbackFetchesCounter(f.meterProvider)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create agent config fallback telemetry: %s", err))
+		fetches, _ = newFallbackFetchesCounter(noop.NewMeterProvider())
+	}
+	f.fetches = fetches
+	return f
+}
+
+func newFallbackFetchesCounter(mp metric.MeterProvider) (metric.Int64Counter, error) {
+	return mp.Meter(scopeName).Int64Counter(
+		"agentcfg.fallback.fetches",
+		metric.WithDescription("Number of agent config fetches by the source that answered them."),
+		metric.WithUnit("{fetch}"),
+	)
+}
+
+// Fetch finds a matching agent config using the primary fetcher, or the
+// fallback fetcher if the primary one cannot serve the query.
+func (f *FallbackFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	result, err := f.primary.Fetch(ctx, query)
+	if err == nil || !isFallbackError(err) {
+		f.record(ctx, sourcePrimary, err)
+		return result, err
+	}
+
+	f.logger.Debug(fmt.Sprintf("primary fetcher cannot serve agent config, using fallback: %s", err))
+	result, err = f.fallback.Fetch(ctx, query)
+	f.record(ctx, sourceFallback, err)
+	return result, err
+}
+
+func (f *FallbackFetcher) record(ctx context.Context, source string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	f.fetches.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("source", source),
+		attribute.String("outcome", outcome),
+	))
+
+	if err == nil && f.lastSource.Swap(source) != source {
+		f.logger.Info(fmt.Sprintf("serving agent config from %s fetcher", source))
+	}
+}
+
+// isFallbackError reports whether err indicates that a fetcher cannot serve
+// queries at all, as opposed to failing a single query.
+func isFallbackError(err error) bool {
+	return errors.Is(err, ErrNotReady) ||
+		errors.Is(err, ErrInvalidElasticsearchConfig) ||
+		errors.Is(err, ErrInvalidKibanaConfig)
+}
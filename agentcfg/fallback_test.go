@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata/metricdatatest"
+	"go.uber.org/zap"
+)
+
+func TestFallbackFetcher(t *testing.T) {
+	primaryResult := Result{Source: Source{Settings: Settings{"key": "primary"}, Etag: "1"}}
+	fallbackResult := Result{Source: Source{Settings: Settings{"key": "fallback"}, Etag: "2"}}
+
+	for _, tc := range []struct {
+		primaryErr     error
+		expectedErr    error
+		name           string
+		expectedSource string
+		expectedResult Result
+	}{
+		{
+			name:           "primary_ready",
+			expectedResult: primaryResult,
+			expectedSource: sourcePrimary,
+		},
+		{
+			name:           "primary_not_ready",
+			primaryErr:     ErrNotReady,
+			expectedResult: fallbackResult,
+			expectedSource: sourceFallback,
+		},
+		{
+			name:           "primary_invalid_elasticsearch_config",
+			primaryErr:     fmt.Errorf("tenant: %w", ErrInvalidElasticsearchConfig),
+			expectedResult: fallbackResult,
+			expectedSource: sourceFallback,
+		},
+		{
+			name:           "primary_invalid_kibana_config",
+			primaryErr:     ErrInvalidKibanaConfig,
+			expectedResult: fallbackResult,
+			expectedSource: sourceFallback,
+		},
+		{
+			name:           "primary_query_error",
+			primaryErr:     errors.New("boom"),
+			expectedErr:    errors.New("boom"),
+			expectedSource: sourcePrimary,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := &fetcherMock{fetchFn: func(context.Context, Query) (Result, error) {
+				if tc.primaryErr != nil {
+					return Result{}, tc.primaryErr
+				}
+				return primaryResult, nil
+			}}
+			fallback := &fetcherMock{fetchFn: func(context.Context, Query) (Result, error) {
+				return fallbackResult, nil
+			}}
+			reader := sdkmetric.NewManualReader()
+			fetcher := NewFallbackFetcher(primary, fallback, zap.NewNop(),
+				WithFallbackMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+			)
+
+			result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+			if tc.expectedErr != nil {
+				require.EqualError(t, err, tc.expectedErr.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedResult, result)
+			}
+
+			outcome := "success"
+			if tc.expectedErr != nil {
+				outcome = "failure"
+			}
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, reader.Collect(context.Background(), &rm))
+			require.Len(t, rm.ScopeMetrics, 1)
+			require.Len(t, rm.ScopeMetrics[0].Metrics, 1)
+			metricdatatest.AssertEqual(t, metricdata.Metrics{
+				Name:        "agentcfg.fallback.fetches",
+				Description: "Number of agent config fetches by the source that answered them.",
+				Unit:        "{fetch}",
+				Data: metricdata.Sum[int64]{
+					Temporality: metricdata.CumulativeTemporality,
+					IsMonotonic: true,
+					DataPoints: []metricdata.DataPoint[int64]{{
+						Attributes: attribute.NewSet(
+							attribute.String("source", tc.expectedSource),
+							attribute.String("outcome", outcome),
+						),
+						Value: 1,
+					}},
+				},
+			}, rm.ScopeMetrics[0].Metrics[0], metricdatatest.IgnoreTimestamp())
+		})
+	}
+}
@@ -19,6 +19,9 @@ package agentcfg // import "github.com/elastic/opentelemetry-collector-component
 
 import (
 	"context"
+	"math"
+	"slices"
+	"strings"
 )
 
 // TransactionSamplingRateKey is the agent configuration key for the
@@ -42,59 +45,180 @@ type AgentConfig struct {
 	// ServiceEnvironment holds the service environment to which this agent
 	// configuration applies. This is optional.
 	ServiceEnvironment string
-	// AgentName holds the agent name to which this agent configuration
-	// applies. This is optional, and is used for filtering configuration
-	// settings for unauthenticated agents.
+	// AgentName holds the agent name, or agent name prefix, to which this
+	// agent configuration applies. This is optional. Agent configurations
+	// for the query agent take precedence over those without agent name,
+	// see agentConfigIndex.find. It is also used for filtering
+	// configuration settings for unauthenticated agents.
 	AgentName string
 	// Etag holds a unique ID for the configuration, which agents
 	// will send along with their queries. The server uses this to
 	// determine whether agent configuration has been applied.
 	Etag string
+	// Instance optionally restricts the configuration to the agent
+	// instances with matching attributes. See agentConfigIndex.find for
+	// the precedence of configurations targeting instances.
+	Instance Instance
+	// Rollout optionally restricts Config and Etag to a percentage of the
+	// matching agent instances, the other instances being served the
+	// rollout baseline.
+	Rollout *Rollout
+	// ID holds the ID of the document the configuration was loaded from,
+	// if any.
+	ID string
+	// AppliedByAgent reports whether an agent has already acknowledged
+	// applying the configuration identified by Etag.
+	AppliedByAgent bool
 }
 
-// matchAgentConfig finds a matching AgentConfig based on the received Query.
+// MatchAgentConfig finds a matching AgentConfig based on the received Query,
+// restricting its settings to UnrestrictedSettings for insecure agents.
+// Return an empty result if no matching result is found.
+//
+// MatchAgentConfig indexes cfgs on every call, it is meant for fetchers
+// holding few configs, such as test fakes.
+func MatchAgentConfig(query Query, cfgs []AgentConfig) Result {
+	return restrictSettings(query, newAgentConfigIndex(cfgs).match(query), UnrestrictedSettings)
+}
+
+// restrictSettings filters the result settings down to the unrestricted
+// ones if the result agent name matches any of the query InsecureAgents.
+func restrictSettings(query Query, result Result, unrestricted map[string]bool) Result {
+	if !hasAnyPrefix(result.Source.Agent, query.InsecureAgents) {
+		return result
+	}
+	settings := make(Settings, len(unrestricted))
+	for k, v := range result.Source.Settings {
+		if unrestricted[k] {
+			settings[k] = v
+		}
+	}
+	result.Source.Settings = settings
+	return result
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// agentConfigIndex indexes agent configs by service, so that finding the
+// config matching a query takes constant time regardless of the number of
+// configs. The zero value is an empty index.
+type agentConfigIndex struct {
+	// byService holds the configs of each service, the configs targeting
+	// the most specific instances first.
+	byService map[Service][]*AgentConfig
+	cfgs      []AgentConfig
+}
+
+// newAgentConfigIndex returns an index of cfgs. The last config wins if
+// several configs with the same service name, environment, instance
+// specificity and agent name match a query.
+func newAgentConfigIndex(cfgs []AgentConfig) agentConfigIndex {
+	byService := make(map[Service][]*AgentConfig, len(cfgs))
+	for i, cfg := range cfgs {
+		key := Service{Name: cfg.ServiceName, Environment: cfg.ServiceEnvironment}
+		byService[key] = append(byService[key], &cfgs[i])
+	}
+	for _, candidates := range byService {
+		slices.SortStableFunc(candidates, func(a, b *AgentConfig) int {
+			return compareSpecificity(b.Instance, a.Instance)
+		})
+	}
+	return agentConfigIndex{byService: byService, cfgs: cfgs}
+}
+
+// find finds a matching AgentConfig based on the received Query.
 // Order of precedence:
 // - service.name and service.environment match an AgentConfig
 // - service.name matches an AgentConfig, service.environment == ""
 // - service.environment matches an AgentConfig, service.name == ""
 // - an AgentConfig without a name or environment set
-// Return an empty result if no matching result is found.
-func matchAgentConfig(query Query, cfgs []AgentConfig) Result {
+// At each level, AgentConfigs targeting instances matching the query
+// instance take precedence over AgentConfigs without instance attributes:
+// - service.node.name matches an AgentConfig
+// - host.name matches an AgentConfig
+// - all labels of an AgentConfig match, more labels taking precedence
+// Among AgentConfigs targeting instances alike, AgentConfigs for the query
+// agent take precedence over AgentConfigs without agent name, see
+// agentRank. AgentConfigs for other agents do not match.
+// Return nil if no matching AgentConfig is found.
+func (idx agentConfigIndex) find(query Query) *AgentConfig {
 	name, env := query.Service.Name, query.Service.Environment
-	result := zeroResult()
-	var nameConf, envConf, defaultConf *AgentConfig
-
-	for i, cfg := range cfgs {
-		if cfg.ServiceName == name && cfg.ServiceEnvironment == env {
-			nameConf = &cfgs[i]
-			break
-		} else if cfg.ServiceName == name && cfg.ServiceEnvironment == "" {
-			nameConf = &cfgs[i]
-		} else if cfg.ServiceName == "" && cfg.ServiceEnvironment == env {
-			envConf = &cfgs[i]
-		} else if cfg.ServiceName == "" && cfg.ServiceEnvironment == "" {
-			defaultConf = &cfgs[i]
+	for _, key := range [...]Service{
+		{Name: name, Environment: env},
+		{Name: name},
+		{Environment: env},
+		{},
+	} {
+		var best *AgentConfig
+		bestRank := -1
+		for _, cfg := range idx.byService[key] {
+			if best != nil && compareSpecificity(cfg.Instance, best.Instance) < 0 {
+				break
+			}
+			if !cfg.Instance.matches(query.Instance) {
+				continue
+			}
+			if rank := agentRank(cfg.AgentName, query.AgentName); rank >= 0 && rank >= bestRank {
+				best, bestRank = cfg, rank
+			}
+		}
+		if best != nil {
+			return best
 		}
 	}
+	return nil
+}
 
-	if nameConf != nil {
-		result = Result{Source{
-			Settings: nameConf.Config,
-			Etag:     nameConf.Etag,
-			Agent:    nameConf.AgentName,
-		}}
-	} else if envConf != nil {
-		result = Result{Source{
-			Settings: envConf.Config,
-			Etag:     envConf.Etag,
-			Agent:    envConf.AgentName,
-		}}
-	} else if defaultConf != nil {
-		result = Result{Source{
-			Settings: defaultConf.Config,
-			Etag:     defaultConf.Etag,
-			Agent:    defaultConf.AgentName,
-		}}
+// agentRank ranks the agent name, or agent name prefix, of an AgentConfig
+// for the query agent: higher ranks take precedence, negative ranks do not
+// match. An exact agent name match takes precedence over prefix matches,
+// longer prefixes first, which take precedence over AgentConfigs without
+// agent name.
+//
+// Queries without agent name, e.g. of agents not sending it, match all
+// AgentConfigs, those without agent name taking precedence.
+func agentRank(cfgAgent, queryAgent string) int {
+	switch {
+	case cfgAgent == "" && queryAgent == "":
+		return 1
+	case cfgAgent == "" || queryAgent == "":
+		return 0
+	case cfgAgent == queryAgent:
+		return math.MaxInt
+	case strings.HasPrefix(queryAgent, cfgAgent):
+		return len(cfgAgent)
 	}
-	return result
+	return -1
+}
+
+// match returns the result holding the AgentConfig matching query, or an
+// empty result if no matching AgentConfig is found.
+func (idx agentConfigIndex) match(query Query) Result {
+	cfg := idx.find(query)
+	if cfg == nil {
+		return zeroResult()
+	}
+	settings, etag := cfg.resolve(query)
+	return Result{Source{
+		Settings: settings,
+		Etag:     etag,
+		Agent:    cfg.AgentName,
+	}}
+}
+
+// resolve returns the settings and etag of cfg served to the agent
+// instance of query, which are those of the rollout baseline if cfg is
+// rolled out to a percentage of instances not including it.
+func (cfg *AgentConfig) resolve(query Query) (map[string]string, string) {
+	if cfg.Rollout != nil && !cfg.Rollout.includes(query.Service.Name, query.Instance) {
+		return cfg.Rollout.Baseline, cfg.Rollout.BaselineEtag
+	}
+	return cfg.Config, cfg.Etag
 }
@@ -19,6 +19,7 @@ package agentcfg
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -149,8 +150,6 @@ func TestDirectConfigurationPrecedence(t *testing.T) {
 				},
 			},
 			expectedSettings: map[string]string{
-				"key1":                    "val1",
-				"key2":                    "val2",
 				"transaction_sample_rate": "0.1",
 			},
 		},
@@ -248,7 +247,7 @@ func TestDirectConfigurationPrecedence(t *testing.T) {
 	} {
 		f := fetcherMock{
 			fetchFn: func(_ctx context.Context, query Query) (Result, error) {
-				return matchAgentConfig(query, tc.agentConfigs), nil
+				return MatchAgentConfig(query, tc.agentConfigs), nil
 			},
 		}
 		result, err := f.Fetch(context.Background(), tc.query)
@@ -257,3 +256,195 @@ func TestDirectConfigurationPrecedence(t *testing.T) {
 		assert.Equal(t, Settings(tc.expectedSettings), result.Source.Settings)
 	}
 }
+
+func TestInstancePrecedence(t *testing.T) {
+	cfgs := []AgentConfig{
+		{ServiceName: "opbeans", Etag: "service"},
+		{ServiceName: "opbeans", Instance: Instance{Labels: map[string]string{"region": "eu"}}, Etag: "region"},
+		{ServiceName: "opbeans", Instance: Instance{Labels: map[string]string{"region": "eu", "zone": "a"}}, Etag: "zone"},
+		{ServiceName: "opbeans", Instance: Instance{HostName: "host-1"}, Etag: "host"},
+		{ServiceName: "opbeans", Instance: Instance{NodeName: "opbeans-1"}, Etag: "node"},
+		{ServiceName: "opbeans", ServiceEnvironment: "production", Etag: "production"},
+		{Instance: Instance{NodeName: "opbeans-2"}, Etag: "default_node"},
+	}
+	for _, tc := range []struct {
+		instance     *Instance
+		name         string
+		env          string
+		expectedEtag string
+	}{
+		{name: "no_instance", expectedEtag: "service"},
+		{name: "no_match", instance: &Instance{NodeName: "opbeans-3", Labels: map[string]string{"region": "us"}}, expectedEtag: "service"},
+		{name: "labels", instance: &Instance{Labels: map[string]string{"region": "eu", "other": "x"}}, expectedEtag: "region"},
+		{name: "more_labels", instance: &Instance{Labels: map[string]string{"region": "eu", "zone": "a"}}, expectedEtag: "zone"},
+		{name: "host", instance: &Instance{HostName: "host-1", Labels: map[string]string{"region": "eu", "zone": "a"}}, expectedEtag: "host"},
+		{name: "node", instance: &Instance{NodeName: "opbeans-1", HostName: "host-1"}, expectedEtag: "node"},
+		{name: "environment_first", env: "production", instance: &Instance{NodeName: "opbeans-1"}, expectedEtag: "production"},
+		{name: "service_first", instance: &Instance{NodeName: "opbeans-2"}, expectedEtag: "service"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query := Query{Service: Service{Name: "opbeans", Environment: tc.env}, Instance: tc.instance}
+			assert.Equal(t, tc.expectedEtag, MatchAgentConfig(query, cfgs).Source.Etag)
+		})
+	}
+	query := Query{Service: Service{Name: "other"}, Instance: &Instance{NodeName: "opbeans-2"}}
+	assert.Equal(t, "default_node", MatchAgentConfig(query, cfgs).Source.Etag)
+}
+
+func TestAgentNamePrecedence(t *testing.T) {
+	cfgs := []AgentConfig{
+		{ServiceName: "opbeans", AgentName: "java", Etag: "java"},
+		{ServiceName: "opbeans", Etag: "service"},
+		{ServiceName: "opbeans", AgentName: "opentelemetry/", Etag: "opentelemetry"},
+		{ServiceName: "opbeans", AgentName: "opentelemetry/java", Etag: "opentelemetry_java"},
+		{ServiceName: "opbeans", Instance: Instance{NodeName: "opbeans-1"}, Etag: "node"},
+		{ServiceName: "opbeans", AgentName: "java", Instance: Instance{HostName: "host-1"}, Etag: "java_host"},
+		{ServiceName: "opbeans", ServiceEnvironment: "production", AgentName: "go", Etag: "production_go"},
+		{ServiceName: "frontend", AgentName: "rum-js", Etag: "rum"},
+	}
+	for _, tc := range []struct {
+		instance     *Instance
+		name         string
+		service      Service
+		agent        string
+		expectedEtag string
+	}{
+		{name: "unknown_agent", service: Service{Name: "opbeans"}, expectedEtag: "service"},
+		{name: "exact", service: Service{Name: "opbeans"}, agent: "java", expectedEtag: "java"},
+		{name: "prefix", service: Service{Name: "opbeans"}, agent: "opentelemetry/go", expectedEtag: "opentelemetry"},
+		{name: "exact_first", service: Service{Name: "opbeans"}, agent: "opentelemetry/java", expectedEtag: "opentelemetry_java"},
+		{name: "longest_prefix_first", service: Service{Name: "opbeans"}, agent: "opentelemetry/java/elastic", expectedEtag: "opentelemetry_java"},
+		{name: "agnostic", service: Service{Name: "opbeans"}, agent: "nodejs", expectedEtag: "service"},
+		{name: "instance_first", service: Service{Name: "opbeans"}, agent: "java", instance: &Instance{NodeName: "opbeans-1"}, expectedEtag: "node"},
+		{name: "instance_agent", service: Service{Name: "opbeans"}, agent: "java", instance: &Instance{HostName: "host-1"}, expectedEtag: "java_host"},
+		{name: "instance_other_agent", service: Service{Name: "opbeans"}, agent: "go", instance: &Instance{HostName: "host-1"}, expectedEtag: "service"},
+		{name: "environment_other_agent", service: Service{Name: "opbeans", Environment: "production"}, agent: "java", expectedEtag: "java"},
+		{name: "environment_agent", service: Service{Name: "opbeans", Environment: "production"}, agent: "go", expectedEtag: "production_go"},
+		{name: "agent_metadata", service: Service{Name: "frontend"}, expectedEtag: "rum"},
+		{name: "other_agent", service: Service{Name: "frontend"}, agent: "js-base", expectedEtag: EtagSentinel},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query := Query{Service: tc.service, AgentName: tc.agent, Instance: tc.instance}
+			assert.Equal(t, tc.expectedEtag, MatchAgentConfig(query, cfgs).Source.Etag)
+		})
+	}
+}
+
+func TestRollout(t *testing.T) {
+	rollout := &Rollout{Baseline: map[string]string{TransactionSamplingRateKey: "0.5"}, BaselineEtag: "baseline", Percentage: 25}
+	index := newAgentConfigIndex([]AgentConfig{{
+		ServiceName: "opbeans",
+		Config:      map[string]string{TransactionSamplingRateKey: "0.1"},
+		Etag:        "canary",
+		Rollout:     rollout,
+	}})
+	query := func(i int) Query {
+		return Query{Service: Service{Name: "opbeans"}, Instance: &Instance{NodeName: fmt.Sprintf("opbeans-%d", i)}}
+	}
+
+	const n = 10000
+	included := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		result := index.match(query(i))
+		switch result.Source.Etag {
+		case "canary":
+			assert.Equal(t, Settings{TransactionSamplingRateKey: "0.1"}, result.Source.Settings)
+			included[i] = true
+		case "baseline":
+			assert.Equal(t, Settings{TransactionSamplingRateKey: "0.5"}, result.Source.Settings)
+		default:
+			t.Fatalf("unexpected etag %q", result.Source.Etag)
+		}
+		// Bucketing is deterministic.
+		assert.Equal(t, result, index.match(query(i)))
+	}
+	assert.InEpsilon(t, n/4, len(included), 0.1)
+
+	// Included instances stay included as the rollout grows.
+	rollout.Percentage = 50
+	var grown int
+	for i := 0; i < n; i++ {
+		etag := index.match(query(i)).Source.Etag
+		if included[i] {
+			assert.Equal(t, "canary", etag)
+		}
+		if etag == "canary" {
+			grown++
+		}
+	}
+	assert.InEpsilon(t, n/2, grown, 0.1)
+
+	// Instances without identity are only included in complete rollouts.
+	assert.Equal(t, "baseline", index.match(Query{Service: Service{Name: "opbeans"}}).Source.Etag)
+	rollout.Percentage = 100
+	assert.Equal(t, "canary", index.match(Query{Service: Service{Name: "opbeans"}}).Source.Etag)
+}
+
+func TestAgentConfigIndexLastConfigWins(t *testing.T) {
+	index := newAgentConfigIndex([]AgentConfig{
+		{ServiceName: "service1", Etag: "first"},
+		{ServiceName: "service1", AgentName: "java", Etag: "java"},
+		{ServiceName: "service1", Etag: "second"},
+		{ServiceName: "service1", ServiceEnvironment: "production", Etag: "first_production"},
+		{ServiceName: "service1", ServiceEnvironment: "production", Etag: "second_production"},
+		{ServiceEnvironment: "production", Etag: "first_environment"},
+		{ServiceEnvironment: "production", Etag: "second_environment"},
+		{Etag: "first_default"},
+		{Etag: "second_default"},
+	})
+	for _, tc := range []struct {
+		query        Query
+		expectedEtag string
+	}{
+		{query: Query{Service: Service{Name: "service1"}}, expectedEtag: "second"},
+		{query: Query{Service: Service{Name: "service1"}, AgentName: "java"}, expectedEtag: "java"},
+		{query: Query{Service: Service{Name: "service1", Environment: "production"}}, expectedEtag: "second_production"},
+		{query: Query{Service: Service{Name: "service2", Environment: "production"}}, expectedEtag: "second_environment"},
+		{query: Query{Service: Service{Name: "service2"}}, expectedEtag: "second_default"},
+	} {
+		assert.Equal(t, tc.expectedEtag, index.match(tc.query).Source.Etag, tc.query)
+	}
+}
+
+// newBenchmarkAgentConfigs returns n service configs for the production
+// environment, followed by an environment config and a default config.
+func newBenchmarkAgentConfigs(n int) []AgentConfig {
+	cfgs := make([]AgentConfig, 0, n+2)
+	for i := 0; i < n; i++ {
+		cfgs = append(cfgs, AgentConfig{
+			ServiceName:        fmt.Sprintf("service-%d", i),
+			ServiceEnvironment: "production",
+			Config:             map[string]string{TransactionSamplingRateKey: "0.5"},
+			Etag:               fmt.Sprintf("etag-%d", i),
+		})
+	}
+	cfgs = append(cfgs,
+		AgentConfig{ServiceEnvironment: "staging", Config: map[string]string{TransactionSamplingRateKey: "1"}, Etag: "staging"},
+		AgentConfig{Config: map[string]string{TransactionSamplingRateKey: "0.1"}, Etag: "default"},
+	)
+	return cfgs
+}
+
+func BenchmarkAgentConfigIndex(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		index := newAgentConfigIndex(newBenchmarkAgentConfigs(n))
+		for _, bc := range []struct {
+			name  string
+			query Query
+		}{
+			{name: "exact", query: Query{Service: Service{Name: fmt.Sprintf("service-%d", n-1), Environment: "production"}}},
+			{name: "default", query: Query{Service: Service{Name: "unknown", Environment: "production"}}},
+		} {
+			query := bc.query
+			b.Run(fmt.Sprintf("%s/%d", bc.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if index.find(query) == nil {
+						b.Fatal("no config found")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// FileFetcher serves agent configurations loaded from a directory of
+// YAML or JSON files. Files are re-read periodically and the cache is
+// swapped whenever their contents change.
+//
+// Every file holds a list of agent configuration entries:
+//
+//	# opbeans.yml
+//	- service:
+//	    name: opbeans-java
+//	    environment: production
+//	  agent_name: java
+//	  settings:
+//	    transaction_sample_rate: 0.5
+//	- service:
+//	    name: opbeans-java
+//	    environment: production
+//	    node:
+//	      name: opbeans-java-1
+//	  settings:
+//	    transaction_sample_rate: 1
+//	- service:
+//	    name: opbeans-go
+//	  settings:
+//	    transaction_sample_rate: 0.1
+//	  rollout:
+//	    percentage: 10
+//	    baseline:
+//	      transaction_sample_rate: 0.5
+//
+// Entries may target agents by agent name, see AgentConfig.AgentName, and
+// agent instances by service.node.name, host.name and labels, see
+// AgentConfig.Instance. Entries with a rollout serve their
+// settings to a percentage of the instances only, see AgentConfig.Rollout.
+//
+// Only files with a .yml, .yaml or .json extension directly inside the
+// directory are considered.
+type FileFetcher struct {
+	logger           *zap.Logger
+	dir              string
+	cache            agentConfigIndex
+	watchers         watchers
+	reloadInterval   time.Duration
+	mu               sync.RWMutex
+	digest           [sha1.Size]byte
+	cacheInitialized atomic.Bool
+}
+
+// NewFileFetcher returns a FileFetcher reading agent configurations from dir
+// and checking it for changes every reloadInterval.
+func NewFileFetcher(
+	dir string,
+	reloadInterval time.Duration,
+	logger *zap.Logger,
+) *FileFetcher {
+	return &FileFetcher{
+		dir:            dir,
+		reloadInterval: reloadInterval,
+		logger:         logger,
+	}
+}
+
+// Fetch finds a matching agent config based on the received query,
+// restricting its settings to UnrestrictedSettings for insecure agents.
+func (f *FileFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	if !f.cacheInitialized.Load() {
+		return Result{}, ErrNotReady
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return restrictSettings(query, f.cache.match(query), UnrestrictedSettings), nil
+}
+
+// Watch returns a channel receiving the agent config of service whenever
+// it changes after a reload. See Watcher.
+func (f *FileFetcher) Watch(ctx context.Context, service Service) <-chan Result {
+	return f.watchers.watch(ctx, service)
+}
+
+// Run loads the agent configuration files and reloads them periodically.
+// A reload that fails keeps serving the previously loaded configurations.
+func (f *FileFetcher) Run(ctx context.Context) error {
+	reload := func() {
+		if err := f.reload(); err != nil {
+			f.logger.Error(fmt.Sprintf("reload agent config files error: %s", err))
+		}
+	}
+
+	// Trigger initial run.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		reload()
+	}
+
+	// Then schedule subsequent runs.
+	t := time.NewTicker(f.reloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			reload()
+		}
+	}
+}
+
+type fileAgentConfig struct {
+	Settings map[string]interface{} `yaml:"settings"`
+	Labels   map[string]string      `yaml:"labels"`
+	Service  struct {
+		Node struct {
+			Name string `yaml:"name"`
+		} `yaml:"node"`
+		Name        string `yaml:"name"`
+		Environment string `yaml:"environment"`
+	} `yaml:"service"`
+	Host struct {
+		Name string `yaml:"name"`
+	} `yaml:"host"`
+	Rollout *struct {
+		Baseline   map[string]interface{} `yaml:"baseline"`
+		Percentage float64                `yaml:"percentage"`
+	} `yaml:"rollout"`
+	AgentName string `yaml:"agent_name"`
+}
+
+// reload reads all agent configuration files and replaces the cache if
+// their contents changed since the last successful reload.
+func (f *FileFetcher) reload() error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	h := sha1.New()
+	var cfgs []AgentConfig
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yml", ".yaml", ".json":
+		default:
+			continue
+		}
+		path := filepath.Join(f.dir, entry.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fileCfgs, err := parseAgentConfigFile(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		cfgs = append(cfgs, fileCfgs...)
+		io.WriteString(h, entry.Name())
+		h.Write(b)
+	}
+
+	var digest [sha1.Size]byte
+	copy(digest[:], h.Sum(nil))
+	if f.cacheInitialized.Load() && digest == f.digest {
+		return nil
+	}
+
+	sanitizeAgentConfigs(cfgs, f.logger)
+	index := newAgentConfigIndex(cfgs)
+	f.mu.Lock()
+	f.cache = index
+	f.mu.Unlock()
+	f.digest = digest
+	f.cacheInitialized.Store(true)
+	f.watchers.update(index)
+	f.logger.Debug(fmt.Sprintf("loaded %d agent configs from %s", len(cfgs), f.dir))
+	return nil
+}
+
+// parseAgentConfigFile decodes a list of agent configurations. JSON is
+// parsed as YAML, of which it is a subset.
+func parseAgentConfigFile(b []byte) ([]AgentConfig, error) {
+	var in []fileAgentConfig
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&in); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	cfgs := make([]AgentConfig, 0, len(in))
+	for _, c := range in {
+		cfg := AgentConfig{
+			ServiceName:        c.Service.Name,
+			ServiceEnvironment: c.Service.Environment,
+			AgentName:          c.AgentName,
+			Instance: Instance{
+				NodeName: c.Service.Node.Name,
+				HostName: c.Host.Name,
+				Labels:   c.Labels,
+			},
+			Config: settingValues(c.Settings),
+		}
+		cfg.Etag = agentConfigEtag(cfg)
+		if c.Rollout != nil {
+			baseline := cfg
+			baseline.Config = settingValues(c.Rollout.Baseline)
+			cfg.Rollout = &Rollout{
+				Baseline:     baseline.Config,
+				BaselineEtag: agentConfigEtag(baseline),
+				Percentage:   c.Rollout.Percentage,
+			}
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+func settingValues(in map[string]interface{}) map[string]string {
+	settings := make(map[string]string, len(in))
+	for k, v := range in {
+		settings[k] = settingValue(v)
+	}
+	return settings
+}
+
+// agentConfigEtag computes an etag for cfg that only changes when the
+// service, agent name or settings of the configuration change. In particular,
+// changing the percentage of a rollout does not change the etag.
+func agentConfigEtag(cfg AgentConfig) string {
+	h := sha1.New()
+	// json.Marshal of strings cannot fail.
+	enc := json.NewEncoder(h)
+	enc.Encode([]string{cfg.ServiceName, cfg.ServiceEnvironment, cfg.AgentName})
+	if !cfg.Instance.IsZero() {
+		enc.Encode(cfg.Instance)
+	}
+	for _, k := range sortedKeys(cfg.Config) {
+		enc.Encode([]string{k, cfg.Config[k]})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,249 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeAgentConfigFile(t testing.TB, dir, name, content string) {
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+}
+
+func TestFileFetcherFetch(t *testing.T) {
+	dir := t.TempDir()
+	writeAgentConfigFile(t, dir, "first.yml", `
+- service:
+    name: first
+  settings:
+    transaction_sample_rate: 0.1
+    sanitize_field_names: foo,bar,baz
+- settings:
+    transaction_sample_rate: 1
+`)
+	writeAgentConfigFile(t, dir, "second.json", `[{"service":{"name":"second","environment":"production"},"agent_name":"java","settings":{"capture_body":"all"}}]`)
+	writeAgentConfigFile(t, dir, "README.md", "ignored")
+
+	fetcher := NewFileFetcher(dir, time.Second, zap.NewNop())
+	_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.EqualError(t, err, ErrInfrastructureNotReady)
+
+	require.NoError(t, fetcher.reload())
+	require.Len(t, fetcher.cache.cfgs, 3)
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"sanitize_field_names": "foo,bar,baz", "transaction_sample_rate": "0.1"}, result.Source.Settings)
+	assert.NotEmpty(t, result.Source.Etag)
+
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "second", Environment: "production"}})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{
+		Settings: Settings{"capture_body": "all"},
+		Etag:     agentConfigEtag(fetcher.cache.cfgs[2]),
+		Agent:    "java",
+	}}, result)
+
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "other"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "1"}, result.Source.Settings)
+}
+
+func TestFileFetcherInsecureAgents(t *testing.T) {
+	dir := t.TempDir()
+	writeAgentConfigFile(t, dir, "frontend.yml", `
+- service:
+    name: frontend
+  agent_name: rum-js
+  settings:
+    transaction_sample_rate: 0.1
+    capture_body: all
+    log_level: debug
+`)
+	query := Query{Service: Service{Name: "frontend"}, InsecureAgents: []string{"rum-js"}}
+
+	fetcher := NewFileFetcher(dir, time.Second, zap.NewNop())
+	require.NoError(t, fetcher.reload())
+	result, err := fetcher.Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.1"}, result.Source.Settings)
+}
+
+func TestFileFetcherInstance(t *testing.T) {
+	dir := t.TempDir()
+	writeAgentConfigFile(t, dir, "opbeans.yml", `
+- service:
+    name: opbeans
+  settings:
+    transaction_sample_rate: 0.1
+- service:
+    name: opbeans
+    node:
+      name: opbeans-1
+  host:
+    name: host-1
+  labels:
+    region: eu
+  settings:
+    transaction_sample_rate: 1
+`)
+	fetcher := NewFileFetcher(dir, time.Second, zap.NewNop())
+	require.NoError(t, fetcher.reload())
+	require.Len(t, fetcher.cache.cfgs, 2)
+	assert.Equal(t, Instance{NodeName: "opbeans-1", HostName: "host-1", Labels: map[string]string{"region": "eu"}}, fetcher.cache.cfgs[1].Instance)
+	assert.NotEqual(t, fetcher.cache.cfgs[0].Etag, agentConfigEtag(AgentConfig{
+		ServiceName: "opbeans",
+		Instance:    Instance{NodeName: "opbeans-1"},
+		Config:      map[string]string{"transaction_sample_rate": "0.1"},
+	}))
+
+	result, err := fetcher.Fetch(context.Background(), Query{
+		Service:  Service{Name: "opbeans"},
+		Instance: &Instance{NodeName: "opbeans-1", HostName: "host-1", Labels: map[string]string{"region": "eu"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "1"}, result.Source.Settings)
+}
+
+func TestFileFetcherRollout(t *testing.T) {
+	dir := t.TempDir()
+	writeRollout := func(percentage string) {
+		writeAgentConfigFile(t, dir, "opbeans.yml", `
+- service:
+    name: opbeans
+  settings:
+    transaction_sample_rate: 0.1
+  rollout:
+    percentage: `+percentage+`
+    baseline:
+      transaction_sample_rate: 0.5
+- service:
+    name: other
+  settings:
+    transaction_sample_rate: 0.5
+`)
+	}
+	writeRollout("10")
+	fetcher := NewFileFetcher(dir, time.Second, zap.NewNop())
+	require.NoError(t, fetcher.reload())
+	require.Len(t, fetcher.cache.cfgs, 2)
+	cfg := fetcher.cache.cfgs[0]
+	require.NotNil(t, cfg.Rollout)
+	assert.Equal(t, map[string]string{"transaction_sample_rate": "0.5"}, cfg.Rollout.Baseline)
+	assert.Equal(t, 10.0, cfg.Rollout.Percentage)
+	assert.Equal(t, agentConfigEtag(AgentConfig{
+		ServiceName: "opbeans",
+		Config:      map[string]string{"transaction_sample_rate": "0.5"},
+	}), cfg.Rollout.BaselineEtag)
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{
+		Settings: Settings{"transaction_sample_rate": "0.5"},
+		Etag:     cfg.Rollout.BaselineEtag,
+	}}, result)
+
+	// Changing the percentage keeps the etags.
+	writeRollout("100")
+	require.NoError(t, fetcher.reload())
+	assert.Equal(t, cfg.Etag, fetcher.cache.cfgs[0].Etag)
+	assert.Equal(t, cfg.Rollout.BaselineEtag, fetcher.cache.cfgs[0].Rollout.BaselineEtag)
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Source: Source{
+		Settings: Settings{"transaction_sample_rate": "0.1"},
+		Etag:     cfg.Etag,
+	}}, result)
+}
+
+func TestFileFetcherReload(t *testing.T) {
+	dir := t.TempDir()
+	writeAgentConfigFile(t, dir, "config.yaml", `
+- service:
+    name: first
+  settings:
+    transaction_sample_rate: 0.1
+- service:
+    name: second
+  settings:
+    transaction_sample_rate: 0.2
+`)
+	fetcher := NewFileFetcher(dir, time.Second, zap.NewNop())
+	require.NoError(t, fetcher.reload())
+	first, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.NoError(t, err)
+	second, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "second"}})
+	require.NoError(t, err)
+
+	writeAgentConfigFile(t, dir, "config.yaml", `
+- service:
+    name: first
+  settings:
+    transaction_sample_rate: 0.1
+- service:
+    name: second
+  settings:
+    transaction_sample_rate: 0.5
+`)
+	require.NoError(t, fetcher.reload())
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.NoError(t, err)
+	assert.Equal(t, first, result, "unchanged entries keep their etag")
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "second"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.5"}, result.Source.Settings)
+	assert.NotEqual(t, second.Source.Etag, result.Source.Etag)
+
+	// Invalid files are reported and the previous cache is kept.
+	writeAgentConfigFile(t, dir, "config.yaml", "settings: [")
+	require.Error(t, fetcher.reload())
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "second"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.5"}, result.Source.Settings)
+}
+
+func TestFileFetcherRun(t *testing.T) {
+	dir := t.TempDir()
+	fetcher := NewFileFetcher(dir, 10*time.Millisecond, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- fetcher.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		result, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+		return err == nil && result.Source.Etag == EtagSentinel
+	}, time.Second, 10*time.Millisecond)
+
+	writeAgentConfigFile(t, dir, "config.yml", `[{"service":{"name":"first"},"settings":{"log_level":"debug"}}]`)
+	assert.Eventually(t, func() bool {
+		result, err := fetcher.Fetch(ctx, Query{Service: Service{Name: "first"}})
+		return err == nil && result.Source.Settings["log_level"] == "debug"
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,161 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AgentConfigPath is the path of the APM agent configuration endpoint.
+const AgentConfigPath = "/config/v1/agents"
+
+const errMsgServiceNameRequired = "service.name is required"
+
+// maxQueryBodySize holds the maximum size of POST request bodies.
+const maxQueryBodySize = 64 << 10
+
+// Handler serves the APM agent configuration endpoint on top of a Fetcher.
+//
+// Agents query their configuration with GET requests holding the
+// service.name and service.environment query parameters, and optionally
+// the agent.name, service.node.name, host.name and labels.* parameters, or
+// with POST requests holding a JSON encoded Query. The etag of the configuration
+// previously applied by the agent is read from the If-None-Match header,
+// or from the ifnonematch query parameter. Request bodies larger than 64KiB
+// are rejected.
+type Handler struct {
+	fetcher Fetcher
+	logger  *zap.Logger
+	// InsecureAgents holds the agent name prefixes of unauthenticated
+	// agents, see Query.InsecureAgents.
+	InsecureAgents []string
+	cacheMaxAge    time.Duration
+}
+
+// NewHandler returns a Handler serving agent configurations fetched from
+// fetcher. Responses may be cached by agents for cacheMaxAge.
+func NewHandler(fetcher Fetcher, cacheMaxAge time.Duration, logger *zap.Logger) *Handler {
+	return &Handler{
+		fetcher:     fetcher,
+		cacheMaxAge: cacheMaxAge,
+		logger:      logger,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		h.writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	query, err := h.parseQuery(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		h.writeError(w, status, err.Error())
+		return
+	}
+
+	result, err := h.fetcher.Fetch(r.Context(), query)
+	if err != nil {
+		if isFallbackError(err) {
+			h.writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		h.logger.Error(fmt.Sprintf("failed to fetch agent config: %s", err))
+		h.writeError(w, http.StatusInternalServerError, "failed to fetch agent config")
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, must-revalidate", int(h.cacheMaxAge.Seconds())))
+	w.Header().Set("Etag", fmt.Sprintf("%q", result.Source.Etag))
+	if query.Etag == result.Source.Etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, result.Source.Settings)
+}
+
+func (h *Handler) parseQuery(w http.ResponseWriter, r *http.Request) (Query, error) {
+	var query Query
+	if r.Method == http.MethodPost {
+		body := http.MaxBytesReader(w, r.Body, maxQueryBodySize)
+		if err := json.NewDecoder(body).Decode(&query); err != nil {
+			return query, fmt.Errorf("invalid request body: %w", err)
+		}
+	} else {
+		params := r.URL.Query()
+		query.Service.Name = params.Get(ServiceName)
+		query.Service.Environment = params.Get(ServiceEnv)
+		query.Etag = params.Get(Etag)
+		query.AgentName = params.Get(AgentName)
+		query.Instance = parseInstance(params)
+	}
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		query.Etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	}
+	if query.Service.Name == "" {
+		return query, errors.New(errMsgServiceNameRequired)
+	}
+	query.InsecureAgents = h.InsecureAgents
+	return query, nil
+}
+
+// parseInstance returns the instance attributes held by the
+// service.node.name, host.name and labels.* query parameters, or nil.
+func parseInstance(params url.Values) *Instance {
+	var instance Instance
+	instance.NodeName = params.Get(ServiceNodeName)
+	instance.HostName = params.Get(HostName)
+	for k, v := range params {
+		if name, ok := strings.CutPrefix(k, LabelsPrefix); ok && name != "" && len(v) > 0 {
+			if instance.Labels == nil {
+				instance.Labels = make(map[string]string)
+			}
+			instance.Labels[name] = v[0]
+		}
+	}
+	if instance.IsZero() {
+		return nil
+	}
+	return &instance
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, status int, msg string) {
+	h.writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Debug(fmt.Sprintf("failed to write agent config response: %s", err))
+	}
+}
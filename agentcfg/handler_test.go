@@ -0,0 +1,222 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestHandler(t *testing.T) {
+	cfgs := []AgentConfig{
+		{ServiceName: "opbeans", ServiceEnvironment: "production", AgentName: "rum-js", Config: map[string]string{"transaction_sample_rate": "0.5", "capture_body": "all"}, Etag: "abc"},
+		{ServiceName: "opbeans", Config: map[string]string{"transaction_sample_rate": "1"}, Etag: "def"},
+		{ServiceName: "opbeans", Instance: Instance{Labels: map[string]string{"region": "eu"}}, Config: map[string]string{"transaction_sample_rate": "0.1"}, Etag: "ghi"},
+		{ServiceName: "opbeans", AgentName: "opentelemetry/", Config: map[string]string{"transaction_sample_rate": "0.2"}, Etag: "jkl"},
+	}
+	var lastQuery Query
+	fetcher := &fetcherMock{fetchFn: func(_ context.Context, query Query) (Result, error) {
+		lastQuery = query
+		switch query.Service.Name {
+		case "not-ready":
+			return Result{}, ErrNotReady
+		case "broken":
+			return Result{}, errors.New("boom")
+		}
+		return MatchAgentConfig(query, cfgs), nil
+	}}
+	handler := NewHandler(fetcher, 30*time.Second, zap.NewNop())
+
+	for _, tc := range []struct {
+		header         http.Header
+		name           string
+		method         string
+		target         string
+		body           string
+		expectedBody   string
+		expectedEtag   string
+		expectedQuery  Query
+		expectedStatus int
+	}{
+		{
+			name:           "get",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=opbeans&service.environment=production",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"transaction_sample_rate":"0.5","capture_body":"all"}`,
+			expectedEtag:   `"abc"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans", Environment: "production"}},
+		},
+		{
+			name:           "post",
+			method:         http.MethodPost,
+			target:         "/config/v1/agents",
+			body:           `{"service":{"name":"opbeans","environment":"staging"}}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"transaction_sample_rate":"1"}`,
+			expectedEtag:   `"def"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans", Environment: "staging"}},
+		},
+		{
+			name:           "instance",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=opbeans&service.node.name=opbeans-1&host.name=host-1&labels.region=eu",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"transaction_sample_rate":"0.1"}`,
+			expectedEtag:   `"ghi"`,
+			expectedQuery: Query{
+				Service:  Service{Name: "opbeans"},
+				Instance: &Instance{NodeName: "opbeans-1", HostName: "host-1", Labels: map[string]string{"region": "eu"}},
+			},
+		},
+		{
+			name:           "agent_name",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=opbeans&agent.name=opentelemetry/java",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"transaction_sample_rate":"0.2"}`,
+			expectedEtag:   `"jkl"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans"}, AgentName: "opentelemetry/java"},
+		},
+		{
+			name:           "no_config",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=other",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{}`,
+			expectedEtag:   `"-"`,
+			expectedQuery:  Query{Service: Service{Name: "other"}},
+		},
+		{
+			name:           "if_none_match",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=opbeans&service.environment=production",
+			header:         http.Header{"If-None-Match": []string{`"abc"`}},
+			expectedStatus: http.StatusNotModified,
+			expectedEtag:   `"abc"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans", Environment: "production"}, Etag: "abc"},
+		},
+		{
+			name:           "ifnonematch_param",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=opbeans&ifnonematch=def",
+			expectedStatus: http.StatusNotModified,
+			expectedEtag:   `"def"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans"}, Etag: "def"},
+		},
+		{
+			name:           "outdated_etag",
+			method:         http.MethodPost,
+			target:         "/config/v1/agents",
+			body:           `{"service":{"name":"opbeans"},"etag":"old"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"transaction_sample_rate":"1"}`,
+			expectedEtag:   `"def"`,
+			expectedQuery:  Query{Service: Service{Name: "opbeans"}, Etag: "old"},
+		},
+		{
+			name:           "missing_service_name",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"service.name is required"}`,
+		},
+		{
+			name:           "invalid_body",
+			method:         http.MethodPost,
+			target:         "/config/v1/agents",
+			body:           `{`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"invalid request body: unexpected EOF"}`,
+		},
+		{
+			name:           "body_too_large",
+			method:         http.MethodPost,
+			target:         "/config/v1/agents",
+			body:           `{"service":{"name":"` + strings.Repeat("a", maxQueryBodySize) + `"}}`,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedBody:   `{"error":"invalid request body: http: request body too large"}`,
+		},
+		{
+			name:           "method_not_allowed",
+			method:         http.MethodPut,
+			target:         "/config/v1/agents",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   `{"error":"method PUT not allowed"}`,
+		},
+		{
+			name:           "not_ready",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=not-ready",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   `{"error":"agentcfg infrastructure is not ready"}`,
+		},
+		{
+			name:           "fetch_error",
+			method:         http.MethodGet,
+			target:         "/config/v1/agents?service.name=broken",
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   `{"error":"failed to fetch agent config"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lastQuery = Query{}
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			} else {
+				assert.Empty(t, rec.Body.String())
+			}
+			assert.Equal(t, tc.expectedEtag, rec.Header().Get("Etag"))
+			if tc.expectedEtag != "" {
+				assert.Equal(t, "max-age=30, must-revalidate", rec.Header().Get("Cache-Control"))
+				assert.Equal(t, tc.expectedQuery, lastQuery)
+			}
+		})
+	}
+}
+
+func TestHandlerInsecureAgents(t *testing.T) {
+	cfgs := []AgentConfig{
+		{ServiceName: "opbeans", AgentName: "rum-js", Config: map[string]string{"transaction_sample_rate": "0.5", "capture_body": "all"}, Etag: "abc"},
+	}
+	handler := NewHandler(&fetcherMock{fetchFn: func(_ context.Context, query Query) (Result, error) {
+		return MatchAgentConfig(query, cfgs), nil
+	}}, time.Minute, zap.NewNop())
+	handler.InsecureAgents = []string{"rum-js"}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=opbeans", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.5"}`, rec.Body.String())
+}
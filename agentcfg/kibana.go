@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// KibanaAgentConfigSearchPath is the Kibana API path used for searching
+// agent configurations.
+const KibanaAgentConfigSearchPath = "/api/apm/settings/agent-configuration/search"
+
+// ErrNoValidKibanaConfig is an error where the server is not properly
+// configured to fetch agent configuration from Kibana.
+const ErrNoValidKibanaConfig = "no valid kibana config to fetch agent config"
+
+// ErrInvalidKibanaConfig is the error holding the ErrNoValidKibanaConfig
+// message returned by fetchers, to be matched with errors.Is.
+var ErrInvalidKibanaConfig = errors.New(ErrNoValidKibanaConfig)
+
+// KibanaFetcher fetches agent configuration through the Kibana APM agent
+// configuration API, for deployments where the credentials cannot read the
+// agent configuration index directly.
+//
+// Every Fetch results in a request to Kibana. Kibana uses the query etag, or
+// the MarkAsAppliedByAgent flag, to record that the configuration has been
+// applied by the agent.
+type KibanaFetcher struct {
+	client *http.Client
+	logger *zap.Logger
+	url    string
+}
+
+// NewKibanaFetcher returns a KibanaFetcher sending requests to the Kibana
+// instance at kibanaURL. Authentication is expected to be handled by client.
+func NewKibanaFetcher(
+	client *http.Client,
+	kibanaURL string,
+	logger *zap.Logger,
+) *KibanaFetcher {
+	return &KibanaFetcher{
+		client: client,
+		url:    strings.TrimSuffix(kibanaURL, "/") + KibanaAgentConfigSearchPath,
+		logger: logger,
+	}
+}
+
+// Fetch queries Kibana for the agent config matching the received query.
+func (f *KibanaFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	// Kibana does not support instance attributes nor agent names, and
+	// rejects queries with unknown fields.
+	query.Instance = nil
+	query.AgentName = ""
+	body, err := json.Marshal(query)
+	if err != nil {
+		return Result{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("kbn-xsrf", "1")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// Kibana returns 404 if no configuration matches the query.
+		return zeroResult(), nil
+	case resp.StatusCode >= http.StatusBadRequest:
+		if err == nil {
+			f.logger.Debug(fmt.Sprintf("kibana agent config search returned status %d: %s", resp.StatusCode, string(b)))
+		}
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return Result{}, ErrInvalidKibanaConfig
+		case http.StatusServiceUnavailable:
+			return Result{}, ErrNotReady
+		}
+		return Result{}, fmt.Errorf("kibana agent config search returned status %d", resp.StatusCode)
+	}
+	result, err := newResult(b, err)
+	if err != nil {
+		return Result{}, err
+	}
+	return restrictSettings(query, result, UnrestrictedSettings), nil
+}
@@ -0,0 +1,122 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newKibanaFetcher(t testing.TB, handler func(http.ResponseWriter, *http.Request)) *KibanaFetcher {
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(srv.Close)
+	return NewKibanaFetcher(srv.Client(), srv.URL+"/", zap.NewNop())
+}
+
+func TestKibanaFetch(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		query        Query
+		expectedBody string
+	}{
+		{
+			name:         "elastic_apm",
+			query:        Query{Service: Service{Name: "opbeans", Environment: "production"}, Etag: "123"},
+			expectedBody: `{"service":{"name":"opbeans","environment":"production"},"etag":"123"}`,
+		},
+		{
+			name:         "third_party",
+			query:        Query{Service: Service{Name: "opbeans"}, MarkAsAppliedByAgent: true},
+			expectedBody: `{"service":{"name":"opbeans"},"etag":"","mark_as_applied_by_agent":true}`,
+		},
+		{
+			name:         "instance",
+			query:        Query{Service: Service{Name: "opbeans"}, Instance: &Instance{NodeName: "opbeans-1"}},
+			expectedBody: `{"service":{"name":"opbeans"},"etag":""}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fetcher := newKibanaFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, KibanaAgentConfigSearchPath, r.URL.Path)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.NotEmpty(t, r.Header.Get("kbn-xsrf"))
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tc.expectedBody, string(body))
+				w.Write([]byte(`{"_id":"1","_source":{"settings":{"transaction_sample_rate":0.5},"etag":"123","agent_name":"java"}}`))
+			})
+
+			result, err := fetcher.Fetch(context.Background(), tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, Result{Source: Source{
+				Settings: Settings{"transaction_sample_rate": "0.5"},
+				Etag:     "123",
+				Agent:    "java",
+			}}, result)
+		})
+	}
+}
+
+func TestKibanaFetchInsecureAgents(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"_source":{"settings":{"transaction_sample_rate":"0.1","capture_body":"all","log_level":"debug"},"etag":"1","agent_name":"rum-js"}}`))
+	}
+	query := Query{Service: Service{Name: "frontend"}, InsecureAgents: []string{"rum-js"}}
+
+	result, err := newKibanaFetcher(t, handler).Fetch(context.Background(), query)
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.1"}, result.Source.Settings)
+
+}
+
+func TestKibanaFetchNotFound(t *testing.T) {
+	fetcher := newKibanaFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+	require.NoError(t, err)
+	assert.Equal(t, zeroResult(), result)
+}
+
+func TestKibanaFetchError(t *testing.T) {
+	for _, tc := range []struct {
+		status      int
+		expectedErr string
+	}{
+		{status: http.StatusUnauthorized, expectedErr: ErrNoValidKibanaConfig},
+		{status: http.StatusForbidden, expectedErr: ErrNoValidKibanaConfig},
+		{status: http.StatusServiceUnavailable, expectedErr: ErrInfrastructureNotReady},
+		{status: http.StatusInternalServerError, expectedErr: "kibana agent config search returned status 500"},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			fetcher := newKibanaFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			})
+			_, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "opbeans"}})
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
@@ -18,8 +18,11 @@
 package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 )
 
 const (
@@ -27,14 +30,24 @@ const (
 	ServiceName = "service.name"
 	// ServiceEnv keyword
 	ServiceEnv = "service.environment"
+	// ServiceNodeName keyword
+	ServiceNodeName = "service.node.name"
+	// HostName keyword
+	HostName = "host.name"
+	// LabelsPrefix is the prefix of label keywords, e.g. labels.region
+	LabelsPrefix = "labels."
+	// AgentName keyword
+	AgentName = "agent.name"
 	// Etag / If-None-Match keyword
 	Etag = "ifnonematch"
 	// EtagSentinel is a value to return back to agents when Kibana doesn't have any configuration
 	EtagSentinel = "-"
 )
 
-// UnrestrictedSettings are settings considered safe to be returned to all requesters,
-// including unauthenticated ones such as RUM.
+// UnrestrictedSettings holds the settings considered safe to be returned to
+// all requesters, including unauthenticated ones such as RUM, and is the
+// default set of settings served to insecure agents, see
+// Query.InsecureAgents.
 var UnrestrictedSettings = map[string]bool{"transaction_sample_rate": true}
 
 // Result models a Kibana response
@@ -52,6 +65,23 @@ type Source struct {
 // Query represents an URL body or query params for agent configuration
 type Query struct {
 	Service Service `json:"service"`
+	// Instance optionally holds the attributes of the querying agent
+	// instance, used to match agent configs targeting specific instances.
+	Instance *Instance `json:"instance,omitempty"`
+	// AgentName optionally holds the name of the querying agent, e.g.
+	// java or opentelemetry/java, used to match agent configs for
+	// specific agents. See AgentConfig.AgentName.
+	//
+	// Setting AgentName excludes agent configs for other agents. Kibana
+	// records the agent name of the service as metadata of the agent
+	// configs it creates, e.g. java, which then no longer match agents
+	// of the service sending another agent name, e.g.
+	// opentelemetry/java/elastic, while they match queries without agent
+	// name.
+	AgentName string `json:"agent_name,omitempty"`
+	// Tenant optionally holds the tenant of the querying agent, see
+	// MultiTenantFetcher.
+	Tenant string `json:"-"`
 	// Etag should be set to the Etag of a previous agent config query result.
 	// When the query is processed by the receiver a new Etag is calculated
 	// for the query result. If Etags from the query and the query result match,
@@ -62,8 +92,9 @@ type Query struct {
 	//
 	// If InsecureAgents is non-empty, and any of the prefixes matches the result,
 	// then the resulting settings will be filtered down to the subset of settings
-	// identified by UnrestrictedSettings. Otherwise, if InsecureAgents is empty,
-	// the agent name is ignored and no restrictions are applied.
+	// identified by UnrestrictedSettings, or by a RestrictedFetcher. Otherwise,
+	// if InsecureAgents is empty, the agent name is ignored and no restrictions
+	// are applied.
 	InsecureAgents []string `json:"-"`
 	// MarkAsAppliedByAgent can be used to signal to the receiver that the response to this
 	// query can be considered to have been applied immediately. When building queries for Elastic APM
@@ -79,17 +110,145 @@ type Service struct {
 	Environment string `json:"environment,omitempty"`
 }
 
+// Instance holds attributes of agent instances. In an AgentConfig, it
+// restricts the configuration to the instances with matching attributes,
+// unset attributes matching all instances.
+type Instance struct {
+	// Labels holds arbitrary labels, e.g. a region.
+	Labels   map[string]string `json:"labels,omitempty"`
+	NodeName string            `json:"node_name,omitempty"`
+	HostName string            `json:"host_name,omitempty"`
+}
+
+// IsZero reports whether no attribute is set.
+func (i Instance) IsZero() bool {
+	return i.NodeName == "" && i.HostName == "" && len(i.Labels) == 0
+}
+
+// matches reports whether the instance q has all the attributes set in i.
+func (i Instance) matches(q *Instance) bool {
+	if i.IsZero() {
+		return true
+	}
+	if q == nil {
+		return false
+	}
+	if i.NodeName != "" && i.NodeName != q.NodeName {
+		return false
+	}
+	if i.HostName != "" && i.HostName != q.HostName {
+		return false
+	}
+	for k, v := range i.Labels {
+		if qv, ok := q.Labels[k]; !ok || qv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// identity returns the identity of the instance q used to bucket it in
+// rollouts, or false if q has no identifying attribute.
+func (q *Instance) identity() (string, bool) {
+	if q == nil || (q.NodeName == "" && q.HostName == "") {
+		return "", false
+	}
+	return q.NodeName + "\x00" + q.HostName, true
+}
+
+// Rollout holds a canary rollout of the settings of an AgentConfig.
+type Rollout struct {
+	// Baseline holds the settings of the instances the rollout does not
+	// include yet.
+	Baseline map[string]string `json:"baseline"`
+	// BaselineEtag holds the etag of Baseline.
+	BaselineEtag string `json:"baseline_etag"`
+	// Percentage holds the percentage, between 0 and 100, of instances
+	// the rollout includes.
+	Percentage float64 `json:"percentage"`
+}
+
+// rolloutBuckets is the number of buckets instances are distributed into,
+// allowing percentages with two decimals.
+const rolloutBuckets = 10000
+
+// includes reports whether the rollout includes the agent instance q of
+// service. Instances are bucketed by a hash of their service name,
+// service.node.name and host.name, so that an instance stays included as
+// the percentage grows. Instances without a node or host name cannot be
+// bucketed and are only included in complete rollouts.
+func (r *Rollout) includes(service string, q *Instance) bool {
+	if r.Percentage >= 100 {
+		return true
+	}
+	identity, ok := q.identity()
+	if !ok {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(service))
+	h.Write([]byte{0})
+	h.Write([]byte(identity))
+	return float64(h.Sum64()%rolloutBuckets) < r.Percentage*rolloutBuckets/100
+}
+
+// compareSpecificity orders instance selectors from the least to the most
+// specific: service.node.name takes precedence over host.name, which takes
+// precedence over labels, more labels being more specific.
+func compareSpecificity(a, b Instance) int {
+	return cmp.Or(
+		cmp.Compare(boolToInt(a.NodeName != ""), boolToInt(b.NodeName != "")),
+		cmp.Compare(boolToInt(a.HostName != ""), boolToInt(b.HostName != "")),
+		cmp.Compare(len(a.Labels), len(b.Labels)),
+	)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // Settings hold agent configuration
 type Settings map[string]string
 
-// UnmarshalJSON overrides default method to convert any JSON type to string
-func (s Settings) UnmarshalJSON(b []byte) error {
-	in := make(map[string]interface{})
-	err := json.Unmarshal(b, &in)
+// UnmarshalJSON decodes settings, keeping string values as is and
+// converting other values to their JSON representation, e.g. 0.5 to "0.5".
+func (s *Settings) UnmarshalJSON(b []byte) error {
+	in := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if *s == nil {
+		*s = make(Settings, len(in))
+	}
 	for k, v := range in {
-		s[k] = fmt.Sprintf("%v", v)
+		var str string
+		if err := json.Unmarshal(v, &str); err == nil {
+			(*s)[k] = str
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, v); err != nil {
+			return err
+		}
+		(*s)[k] = buf.String()
+	}
+	return nil
+}
+
+// settingValue converts a decoded setting value to its string
+// representation, consistently with Settings.UnmarshalJSON.
+func settingValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
 	}
-	return err
+	return string(b)
 }
 
 func zeroResult() Result {
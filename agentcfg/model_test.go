@@ -68,3 +68,23 @@ func TestQueryMarshaling(t *testing.T) {
 		})
 	}
 }
+
+func TestSettingsUnmarshalJSON(t *testing.T) {
+	var s Settings
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"string": "foo",
+		"float": 0.0000001,
+		"int": 100,
+		"bool": true,
+		"nested": {"a": [1, 2]},
+		"null": null
+	}`), &s))
+	assert.Equal(t, Settings{
+		"string": "foo",
+		"float":  "0.0000001",
+		"int":    "100",
+		"bool":   "true",
+		"nested": `{"a":[1,2]}`,
+		"null":   "",
+	}, s)
+}
@@ -0,0 +1,321 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package opampcfg serves agent configurations fetched by an
+// agentcfg.Fetcher to OpAMP agents as remote configurations.
+package opampcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg/opampcfg"
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server/types"
+	"go.uber.org/zap"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+)
+
+const (
+	// ConfigFileName is the key of the settings in the AgentConfigMap
+	// offered to agents. OpAMP reserves the empty key for agents with
+	// a single configuration file.
+	ConfigFileName = ""
+	// ConfigContentType is the content type of the offered settings,
+	// which are encoded as a JSON object of strings.
+	ConfigContentType = "application/json"
+)
+
+const (
+	attrServiceName               = "service.name"
+	attrDeploymentEnvironment     = "deployment.environment"
+	attrDeploymentEnvironmentName = "deployment.environment.name"
+)
+
+// defaultAgentTTL is the duration after which agents which sent no message
+// are forgotten, see WithAgentTTL.
+const defaultAgentTTL = 15 * time.Minute
+
+const serverCapabilities = protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus |
+	protobufs.ServerCapabilities_ServerCapabilities_OffersRemoteConfig
+
+// Bridge offers the agent configurations of a Fetcher to OpAMP agents.
+//
+// Agents are matched by the service.name and deployment.environment
+// identifying attributes of their AgentDescription. When an agent reports
+// a remote config as applied, the etag of the matching configuration is
+// passed to the Fetcher in subsequent queries, allowing it to mark the
+// configuration as applied.
+//
+// A config is offered once, and offered again when it changes, when the
+// agent fails to apply it, or when the agent reports another config, e.g.
+// after a restart.
+//
+// Agents are forgotten when they disconnect, or when they send no message
+// for a while, e.g. because they crashed or lost their connection.
+//
+// Bridge.OnMessage can be used as the OnMessage connection callback of an
+// opamp-go server.
+type Bridge struct {
+	nextPurge time.Time
+	fetcher   agentcfg.Fetcher
+	logger    *zap.Logger
+	agents    map[string]*agentState
+	now       func() time.Time
+	agentTTL  time.Duration
+	mu        sync.Mutex
+}
+
+// BridgeOption configures a Bridge.
+type BridgeOption func(*Bridge)
+
+// WithAgentTTL sets the duration after which agents which sent no message
+// are forgotten. It should be greater than the heartbeat or polling interval
+// of agents. Defaults to 15 minutes.
+func WithAgentTTL(ttl time.Duration) BridgeOption {
+	return func(b *Bridge) {
+		if ttl > 0 {
+			b.agentTTL = ttl
+		}
+	}
+}
+
+// agentState holds the state of an agent, keyed by instance UID.
+type agentState struct {
+	lastSeen time.Time
+	service  agentcfg.Service
+	// appliedEtag holds the etag of the last config applied by the agent.
+	appliedEtag string
+	// offeredEtag and offeredHash identify the last config offered to
+	// the agent.
+	offeredEtag string
+	offeredHash []byte
+	// reportedHash and reportedStatus hold the last remote config status
+	// reported by the agent.
+	reportedHash   []byte
+	reportedStatus protobufs.RemoteConfigStatuses
+}
+
+// NewBridge returns a Bridge offering the agent configurations of fetcher.
+func NewBridge(fetcher agentcfg.Fetcher, logger *zap.Logger, opts ...BridgeOption) *Bridge {
+	b := &Bridge{
+		fetcher:  fetcher,
+		logger:   logger,
+		agents:   make(map[string]*agentState),
+		now:      time.Now,
+		agentTTL: defaultAgentTTL,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// OnMessage handles a message of an agent, returning the response to send
+// back. The response holds a remote config whenever the configuration
+// matching the agent needs to be offered, see Bridge.
+func (b *Bridge) OnMessage(ctx context.Context, _ types.Connection, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	resp := &protobufs.ServerToAgent{
+		InstanceUid:  msg.GetInstanceUid(),
+		Capabilities: uint64(serverCapabilities),
+	}
+	uid := string(msg.GetInstanceUid())
+	if msg.GetAgentDisconnect() != nil {
+		b.mu.Lock()
+		delete(b.agents, uid)
+		b.mu.Unlock()
+		return resp
+	}
+
+	b.mu.Lock()
+	now := b.now()
+	state, ok := b.agents[uid]
+	if desc := msg.GetAgentDescription(); desc != nil {
+		if !ok {
+			state = &agentState{}
+			b.agents[uid] = state
+		}
+		state.service = serviceFromAttributes(desc.GetIdentifyingAttributes())
+	} else if !ok {
+		b.mu.Unlock()
+		// Agents only send their description when it changes, ask
+		// unknown agents, e.g. after a server restart, for their full
+		// state.
+		resp.Flags = uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState)
+		return resp
+	}
+	state.lastSeen = now
+	b.purge(now)
+	if status := msg.GetRemoteConfigStatus(); status != nil {
+		b.updateStatus(state, status)
+	}
+	query := agentcfg.Query{Service: state.service, Etag: state.appliedEtag}
+	b.mu.Unlock()
+
+	acceptsRemoteConfig := msg.GetCapabilities()&uint64(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig) != 0
+	if !acceptsRemoteConfig || query.Service.Name == "" {
+		return resp
+	}
+
+	result, err := b.fetcher.Fetch(ctx, query)
+	if err != nil {
+		resp.ErrorResponse = newErrorResponse(err)
+		if resp.ErrorResponse.Type == protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable {
+			b.logger.Debug(fmt.Sprintf("failed to fetch agent config for service %q: %s", query.Service.Name, err))
+		} else {
+			b.logger.Error(fmt.Sprintf("failed to fetch agent config for service %q: %s", query.Service.Name, err))
+		}
+		return resp
+	}
+	remoteConfig, err := newRemoteConfig(result)
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("failed to encode agent config for service %q: %s", query.Service.Name, err))
+		return resp
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if state.hasConfig(remoteConfig.ConfigHash) || bytes.Equal(remoteConfig.ConfigHash, state.offeredHash) || state.applyingOffer() {
+		// The agent already has, or was offered, the config, or is busy
+		// applying the previous one and will report its status once done.
+		return resp
+	}
+	state.offeredEtag = result.Source.Etag
+	state.offeredHash = remoteConfig.ConfigHash
+	resp.RemoteConfig = remoteConfig
+	return resp
+}
+
+// updateStatus records the remote config status reported by an agent.
+// It must be called with b.mu held.
+func (b *Bridge) updateStatus(state *agentState, status *protobufs.RemoteConfigStatus) {
+	state.reportedHash = status.GetLastRemoteConfigHash()
+	state.reportedStatus = status.GetStatus()
+	if !bytes.Equal(state.reportedHash, state.offeredHash) {
+		// The agent reports another config than the one offered, it did
+		// not receive or lost the offer, e.g. after a restart.
+		state.offeredHash = nil
+		return
+	}
+	switch status.GetStatus() {
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED:
+		state.appliedEtag = state.offeredEtag
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED:
+		b.logger.Warn(fmt.Sprintf(
+			"agent failed to apply config for service %q environment %q: %s",
+			state.service.Name, state.service.Environment, status.GetErrorMessage(),
+		))
+		state.offeredHash = nil
+	}
+}
+
+// purge forgets the agents which sent no message for the agent TTL, at
+// most once per agent TTL. It must be called with b.mu held.
+func (b *Bridge) purge(now time.Time) {
+	if now.Before(b.nextPurge) {
+		return
+	}
+	for uid, state := range b.agents {
+		if now.Sub(state.lastSeen) >= b.agentTTL {
+			delete(b.agents, uid)
+		}
+	}
+	b.nextPurge = now.Add(b.agentTTL)
+}
+
+// hasConfig reports whether the agent reports having, or applying, the
+// config with the given hash.
+func (s *agentState) hasConfig(hash []byte) bool {
+	return bytes.Equal(s.reportedHash, hash) &&
+		s.reportedStatus != protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED
+}
+
+// applyingOffer reports whether the agent reports applying the config last
+// offered to it.
+func (s *agentState) applyingOffer() bool {
+	return s.reportedStatus == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING &&
+		len(s.offeredHash) > 0 && bytes.Equal(s.reportedHash, s.offeredHash)
+}
+
+// newErrorResponse returns the response to an agent whose config could not
+// be fetched. Only the errors of fetchers which cannot serve queries at all
+// are reported as such to agents, other errors may hold details about the
+// fetcher backend.
+func newErrorResponse(err error) *protobufs.ServerErrorResponse {
+	if errors.Is(err, agentcfg.ErrNotReady) ||
+		errors.Is(err, agentcfg.ErrInvalidElasticsearchConfig) ||
+		errors.Is(err, agentcfg.ErrInvalidKibanaConfig) {
+		return &protobufs.ServerErrorResponse{
+			Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable,
+			ErrorMessage: err.Error(),
+		}
+	}
+	return &protobufs.ServerErrorResponse{
+		Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_Unknown,
+		ErrorMessage: "failed to fetch agent config",
+	}
+}
+
+// newRemoteConfig returns the remote config holding the settings of result.
+// The config hash only depends on the settings, so that agents are not sent
+// configs they already have when etags change.
+func newRemoteConfig(result agentcfg.Result) (*protobufs.AgentRemoteConfig, error) {
+	settings := result.Source.Settings
+	if settings == nil {
+		settings = agentcfg.Settings{}
+	}
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+	return &protobufs.AgentRemoteConfig{
+		Config: &protobufs.AgentConfigMap{
+			ConfigMap: map[string]*protobufs.AgentConfigFile{
+				ConfigFileName: {Body: body, ContentType: ConfigContentType},
+			},
+		},
+		ConfigHash: hash[:],
+	}, nil
+}
+
+// serviceFromAttributes returns the service identified by attrs. Both the
+// deprecated deployment.environment attribute and its replacement
+// deployment.environment.name are supported.
+func serviceFromAttributes(attrs []*protobufs.KeyValue) agentcfg.Service {
+	var service agentcfg.Service
+	for _, attr := range attrs {
+		value := attr.GetValue().GetStringValue()
+		switch attr.GetKey() {
+		case attrServiceName:
+			service.Name = value
+		case attrDeploymentEnvironmentName:
+			service.Environment = value
+		case attrDeploymentEnvironment:
+			if service.Environment == "" {
+				service.Environment = value
+			}
+		}
+	}
+	return service
+}
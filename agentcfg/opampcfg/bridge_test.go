@@ -0,0 +1,345 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package opampcfg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client"
+	clienttypes "github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+	servertypes "github.com/open-telemetry/opamp-go/server/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/opentelemetry-lib/agentcfg"
+)
+
+type fetcherFunc func(context.Context, agentcfg.Query) (agentcfg.Result, error)
+
+func (f fetcherFunc) Fetch(ctx context.Context, query agentcfg.Query) (agentcfg.Result, error) {
+	return f(ctx, query)
+}
+
+// testAgent emulates an OpAMP client exchanging messages with a Bridge.
+type testAgent struct {
+	bridge *Bridge
+	uid    []byte
+}
+
+func (a *testAgent) send(t *testing.T, msg *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	t.Helper()
+	msg.InstanceUid = a.uid
+	if msg.Capabilities == 0 {
+		msg.Capabilities = uint64(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus |
+			protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig)
+	}
+	resp := a.bridge.OnMessage(context.Background(), nil, msg)
+	require.NotNil(t, resp)
+	assert.Equal(t, a.uid, resp.GetInstanceUid())
+	return resp
+}
+
+func newAgentDescription(attrs map[string]string) *protobufs.AgentDescription {
+	var desc protobufs.AgentDescription
+	for k, v := range attrs {
+		desc.IdentifyingAttributes = append(desc.IdentifyingAttributes, &protobufs.KeyValue{
+			Key:   k,
+			Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: v}},
+		})
+	}
+	return &desc
+}
+
+func TestBridge(t *testing.T) {
+	result := agentcfg.Result{Source: agentcfg.Source{
+		Settings: agentcfg.Settings{"transaction_sample_rate": "0.5"},
+		Etag:     "abc",
+	}}
+	var queries []agentcfg.Query
+	bridge := NewBridge(fetcherFunc(func(_ context.Context, query agentcfg.Query) (agentcfg.Result, error) {
+		queries = append(queries, query)
+		return result, nil
+	}), zap.NewNop())
+	agent := &testAgent{bridge: bridge, uid: []byte("0123456789abcdef")}
+
+	// Unknown agents are asked for their full state.
+	resp := agent.send(t, &protobufs.AgentToServer{})
+	assert.Equal(t, uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState), resp.GetFlags())
+	assert.Nil(t, resp.GetRemoteConfig())
+	assert.Empty(t, queries)
+
+	resp = agent.send(t, &protobufs.AgentToServer{
+		AgentDescription: newAgentDescription(map[string]string{
+			"service.name":                "opbeans",
+			"deployment.environment.name": "production",
+		}),
+	})
+	require.NotNil(t, resp.GetRemoteConfig())
+	file := resp.GetRemoteConfig().GetConfig().GetConfigMap()[ConfigFileName]
+	require.NotNil(t, file)
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.5"}`, string(file.GetBody()))
+	assert.Equal(t, ConfigContentType, file.GetContentType())
+	hash := resp.GetRemoteConfig().GetConfigHash()
+	assert.NotEmpty(t, hash)
+	assert.Equal(t, []agentcfg.Query{{Service: agentcfg.Service{Name: "opbeans", Environment: "production"}}}, queries)
+
+	// The offered config is not sent again to agents not reporting their
+	// remote config status.
+	resp = agent.send(t, &protobufs.AgentToServer{})
+	assert.Nil(t, resp.GetRemoteConfig())
+
+	// The offered config is not sent again while the agent applies it.
+	resp = agent.send(t, &protobufs.AgentToServer{
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+		},
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+	assert.Equal(t, "", queries[len(queries)-1].Etag)
+
+	// Once applied, the etag of the config is passed to the fetcher.
+	resp = agent.send(t, &protobufs.AgentToServer{
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		},
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+	assert.Equal(t, "abc", queries[len(queries)-1].Etag)
+
+	// Changed configs are offered again.
+	result = agentcfg.Result{Source: agentcfg.Source{
+		Settings: agentcfg.Settings{"transaction_sample_rate": "0.1"},
+		Etag:     "def",
+	}}
+	resp = agent.send(t, &protobufs.AgentToServer{})
+	require.NotNil(t, resp.GetRemoteConfig())
+	assert.NotEqual(t, hash, resp.GetRemoteConfig().GetConfigHash())
+	file = resp.GetRemoteConfig().GetConfig().GetConfigMap()[ConfigFileName]
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.1"}`, string(file.GetBody()))
+	hash = resp.GetRemoteConfig().GetConfigHash()
+
+	// Changes are not offered while the agent applies the offered config.
+	result = agentcfg.Result{Source: agentcfg.Source{
+		Settings: agentcfg.Settings{"transaction_sample_rate": "0.2"},
+		Etag:     "ghi",
+	}}
+	resp = agent.send(t, &protobufs.AgentToServer{
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+		},
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+
+	// They are once the agent fails to apply it.
+	resp = agent.send(t, &protobufs.AgentToServer{
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			ErrorMessage:         "invalid config",
+		},
+	})
+	require.NotNil(t, resp.GetRemoteConfig())
+	hash = resp.GetRemoteConfig().GetConfigHash()
+
+	// Offered configs are offered again if the agent reports another
+	// config, e.g. after a restart or a lost response.
+	resp = agent.send(t, &protobufs.AgentToServer{
+		RemoteConfigStatus: &protobufs.RemoteConfigStatus{},
+	})
+	require.NotNil(t, resp.GetRemoteConfig())
+	assert.Equal(t, hash, resp.GetRemoteConfig().GetConfigHash())
+	assert.Equal(t, "abc", queries[len(queries)-1].Etag)
+
+	// Disconnected agents are forgotten.
+	agent.send(t, &protobufs.AgentToServer{AgentDisconnect: &protobufs.AgentDisconnect{}})
+	resp = agent.send(t, &protobufs.AgentToServer{})
+	assert.Equal(t, uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState), resp.GetFlags())
+}
+
+func TestBridgeIgnoresAgentsWithoutRemoteConfig(t *testing.T) {
+	bridge := NewBridge(fetcherFunc(func(context.Context, agentcfg.Query) (agentcfg.Result, error) {
+		t.Fatal("unexpected fetch")
+		return agentcfg.Result{}, nil
+	}), zap.NewNop())
+	agent := &testAgent{bridge: bridge, uid: []byte("0123456789abcdef")}
+
+	resp := agent.send(t, &protobufs.AgentToServer{
+		Capabilities:     uint64(protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus),
+		AgentDescription: newAgentDescription(map[string]string{"service.name": "opbeans"}),
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+
+	// Agents without service.name have no config.
+	agent.uid = []byte("fedcba9876543210")
+	resp = agent.send(t, &protobufs.AgentToServer{
+		AgentDescription: newAgentDescription(map[string]string{"deployment.environment": "production"}),
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+}
+
+func TestBridgeFetchError(t *testing.T) {
+	fetchErr := agentcfg.ErrNotReady
+	bridge := NewBridge(fetcherFunc(func(context.Context, agentcfg.Query) (agentcfg.Result, error) {
+		return agentcfg.Result{}, fetchErr
+	}), zap.NewNop())
+	agent := &testAgent{bridge: bridge, uid: []byte("0123456789abcdef")}
+
+	resp := agent.send(t, &protobufs.AgentToServer{
+		AgentDescription: newAgentDescription(map[string]string{
+			"service.name":           "opbeans",
+			"deployment.environment": "production",
+		}),
+	})
+	assert.Nil(t, resp.GetRemoteConfig())
+	require.NotNil(t, resp.GetErrorResponse())
+	assert.Equal(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_Unavailable, resp.GetErrorResponse().GetType())
+	assert.Equal(t, agentcfg.ErrInfrastructureNotReady, resp.GetErrorResponse().GetErrorMessage())
+
+	// Details of other errors are not sent to agents.
+	fetchErr = errors.New("elasticsearch returned status 400: query details")
+	resp = agent.send(t, &protobufs.AgentToServer{})
+	require.NotNil(t, resp.GetErrorResponse())
+	assert.Equal(t, protobufs.ServerErrorResponseType_ServerErrorResponseType_Unknown, resp.GetErrorResponse().GetType())
+	assert.Equal(t, "failed to fetch agent config", resp.GetErrorResponse().GetErrorMessage())
+}
+
+func TestBridgeForgetsSilentAgents(t *testing.T) {
+	bridge := NewBridge(fetcherFunc(func(context.Context, agentcfg.Query) (agentcfg.Result, error) {
+		return agentcfg.Result{Source: agentcfg.Source{Settings: agentcfg.Settings{"transaction_sample_rate": "0.5"}, Etag: "abc"}}, nil
+	}), zap.NewNop(), WithAgentTTL(time.Minute))
+	now := time.Now()
+	bridge.now = func() time.Time { return now }
+	crashed := &testAgent{bridge: bridge, uid: []byte("0123456789abcdef")}
+	alive := &testAgent{bridge: bridge, uid: []byte("fedcba9876543210")}
+	desc := newAgentDescription(map[string]string{"service.name": "opbeans"})
+
+	// The first agent drops its connection without sending a disconnect.
+	crashed.send(t, &protobufs.AgentToServer{AgentDescription: desc})
+	alive.send(t, &protobufs.AgentToServer{AgentDescription: desc})
+	now = now.Add(30 * time.Second)
+	alive.send(t, &protobufs.AgentToServer{})
+	assert.Len(t, bridge.agents, 2)
+
+	now = now.Add(time.Minute)
+	alive.send(t, &protobufs.AgentToServer{})
+	assert.Len(t, bridge.agents, 1)
+	assert.Contains(t, bridge.agents, string(alive.uid))
+
+	// Forgotten agents reconnecting are asked for their full state.
+	resp := crashed.send(t, &protobufs.AgentToServer{})
+	assert.Equal(t, uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState), resp.GetFlags())
+}
+
+func TestBridgeOpAMP(t *testing.T) {
+	var mu sync.Mutex
+	var queries []agentcfg.Query
+	bridge := NewBridge(fetcherFunc(func(_ context.Context, query agentcfg.Query) (agentcfg.Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, query)
+		return agentcfg.Result{Source: agentcfg.Source{
+			Settings: agentcfg.Settings{"transaction_sample_rate": "0.5"},
+			Etag:     "abc",
+		}}, nil
+	}), zap.NewNop(), WithAgentTTL(time.Minute))
+	var elapsed atomic.Int64
+	bridge.now = func() time.Time { return time.Now().Add(time.Duration(elapsed.Load())) }
+
+	handler, _, err := server.New(nil).Attach(server.Settings{
+		Callbacks: servertypes.Callbacks{
+			OnConnecting: func(*http.Request) servertypes.ConnectionResponse {
+				return servertypes.ConnectionResponse{
+					Accept:              true,
+					ConnectionCallbacks: servertypes.ConnectionCallbacks{OnMessage: bridge.OnMessage},
+				}
+			},
+		},
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	remoteConfigs := make(chan *protobufs.AgentRemoteConfig, 1)
+	agent := client.NewWebSocket(nil)
+	require.NoError(t, agent.SetAgentDescription(newAgentDescription(map[string]string{
+		"service.name":                "opbeans",
+		"deployment.environment.name": "production",
+	})))
+	require.NoError(t, agent.Start(context.Background(), clienttypes.StartSettings{
+		OpAMPServerURL: "ws" + srv.URL[len("http"):],
+		InstanceUid:    clienttypes.InstanceUid([]byte("0123456789abcdef")),
+		Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus |
+			protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig,
+		Callbacks: clienttypes.Callbacks{
+			OnMessage: func(_ context.Context, msg *clienttypes.MessageData) {
+				if msg.RemoteConfig != nil {
+					remoteConfigs <- msg.RemoteConfig
+				}
+			},
+		},
+	}))
+
+	var remoteConfig *protobufs.AgentRemoteConfig
+	select {
+	case remoteConfig = <-remoteConfigs:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for remote config")
+	}
+	file := remoteConfig.GetConfig().GetConfigMap()[ConfigFileName]
+	require.NotNil(t, file)
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.5"}`, string(file.GetBody()))
+
+	// Once the agent reports the config as applied, its etag is passed
+	// to the fetcher.
+	require.NoError(t, agent.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: remoteConfig.GetConfigHash(),
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[len(queries)-1].Etag == "abc"
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Empty(t, remoteConfigs)
+
+	// Stopped clients close their connection without sending a disconnect,
+	// they are forgotten once silent for the agent TTL.
+	require.NoError(t, agent.Stop(context.Background()))
+	elapsed.Store(int64(time.Minute))
+	other := &testAgent{bridge: bridge, uid: []byte("fedcba9876543210")}
+	other.send(t, &protobufs.AgentToServer{AgentDescription: newAgentDescription(map[string]string{"service.name": "opbeans"})})
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	assert.Len(t, bridge.agents, 1)
+	assert.Contains(t, bridge.agents, string(other.uid))
+}
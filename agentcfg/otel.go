@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"bytes"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OTelFileFormat is the version of the OpenTelemetry SDK declarative
+// configuration file format produced by OTelConfig.YAML.
+const OTelFileFormat = "0.3"
+
+// OTelConfig holds the OpenTelemetry SDK configuration equivalent to Elastic
+// agent settings, see TranslateToOTel.
+type OTelConfig struct {
+	file otelFileConfig
+	// Env holds the OpenTelemetry SDK environment variables.
+	Env map[string]string
+	// Unmapped holds the sorted keys of the settings without OpenTelemetry
+	// SDK equivalent, or whose value has none.
+	Unmapped []string
+}
+
+// otelFileConfig holds the translated properties of the declarative
+// configuration, file_format being written by OTelConfig.YAML.
+type otelFileConfig struct {
+	Disabled       *bool               `yaml:"disabled,omitempty"`
+	TracerProvider *otelTracerProvider `yaml:"tracer_provider,omitempty"`
+}
+
+type otelTracerProvider struct {
+	Sampler otelSampler `yaml:"sampler"`
+}
+
+type otelSampler struct {
+	ParentBased       *otelParentBasedSampler       `yaml:"parent_based,omitempty"`
+	TraceIDRatioBased *otelTraceIDRatioBasedSampler `yaml:"trace_id_ratio_based,omitempty"`
+}
+
+type otelParentBasedSampler struct {
+	Root otelSampler `yaml:"root"`
+}
+
+type otelTraceIDRatioBasedSampler struct {
+	Ratio float64 `yaml:"ratio"`
+}
+
+// otelLogLevels maps Elastic agent log levels to OTEL_LOG_LEVEL values.
+var otelLogLevels = map[string]string{
+	"trace":    "trace",
+	"debug":    "debug",
+	"info":     "info",
+	"warning":  "warn",
+	"error":    "error",
+	"critical": "fatal",
+}
+
+// TranslateToOTel translates Elastic agent settings to the equivalent
+// OpenTelemetry SDK declarative configuration and environment variables:
+//
+//   - transaction_sample_rate to a parent based trace ID ratio sampler,
+//     OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+//   - recording to disabled and OTEL_SDK_DISABLED
+//   - log_level to OTEL_LOG_LEVEL, the file format having no log level
+//
+// Other settings, such as capture_body or transaction_ignore_urls, have no
+// OpenTelemetry SDK equivalent and are reported in OTelConfig.Unmapped.
+// Instrumentation specific options, e.g. URL exclusions of HTTP server
+// instrumentations, are not standardized across SDKs.
+func TranslateToOTel(settings Settings) OTelConfig {
+	cfg := OTelConfig{Env: make(map[string]string)}
+	result := Result{Source: Source{Settings: settings}}
+	for _, key := range sortedKeys(settings) {
+		mapped := false
+		switch key {
+		case TransactionSamplingRateKey:
+			if rate, ok := result.Float(key); ok && rate >= 0 && rate <= 1 {
+				cfg.file.TracerProvider = &otelTracerProvider{Sampler: otelSampler{
+					ParentBased: &otelParentBasedSampler{Root: otelSampler{
+						TraceIDRatioBased: &otelTraceIDRatioBasedSampler{Ratio: rate},
+					}},
+				}}
+				cfg.Env["OTEL_TRACES_SAMPLER"] = "parentbased_traceidratio"
+				cfg.Env["OTEL_TRACES_SAMPLER_ARG"] = strconv.FormatFloat(rate, 'g', -1, 64)
+				mapped = true
+			}
+		case "recording":
+			if recording, ok := result.Bool(key); ok {
+				disabled := !recording
+				cfg.file.Disabled = &disabled
+				cfg.Env["OTEL_SDK_DISABLED"] = strconv.FormatBool(disabled)
+				mapped = true
+			}
+		case "log_level":
+			if level, ok := otelLogLevels[settings[key]]; ok {
+				cfg.Env["OTEL_LOG_LEVEL"] = level
+				mapped = true
+			}
+		}
+		if !mapped {
+			cfg.Unmapped = append(cfg.Unmapped, key)
+		}
+	}
+	return cfg
+}
+
+// YAML returns the declarative configuration in the OpenTelemetry SDK file
+// format. It only holds the translated settings, and is meant to be merged
+// into a complete configuration, e.g. one defining span processors.
+func (c OTelConfig) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("file_format: " + strconv.Quote(OTelFileFormat) + "\n")
+	if c.file == (otelFileConfig{}) {
+		return buf.Bytes(), nil
+	}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.file); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateToOTel(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		settings         Settings
+		expectedYAML     string
+		expectedEnv      map[string]string
+		expectedUnmapped []string
+	}{{
+		name:         "empty",
+		settings:     Settings{},
+		expectedYAML: "file_format: \"0.3\"\n",
+		expectedEnv:  map[string]string{},
+	}, {
+		name: "mapped",
+		settings: Settings{
+			"transaction_sample_rate": "0.25",
+			"recording":               "false",
+			"log_level":               "warning",
+		},
+		expectedYAML: `file_format: "0.3"
+disabled: true
+tracer_provider:
+  sampler:
+    parent_based:
+      root:
+        trace_id_ratio_based:
+          ratio: 0.25
+`,
+		expectedEnv: map[string]string{
+			"OTEL_TRACES_SAMPLER":     "parentbased_traceidratio",
+			"OTEL_TRACES_SAMPLER_ARG": "0.25",
+			"OTEL_SDK_DISABLED":       "true",
+			"OTEL_LOG_LEVEL":          "warn",
+		},
+	}, {
+		name: "unmapped",
+		settings: Settings{
+			"capture_body":            "all",
+			"transaction_ignore_urls": "/health*",
+			"log_level":               "off",
+			"recording":               "true",
+			"transaction_sample_rate": "2",
+		},
+		expectedYAML: "file_format: \"0.3\"\ndisabled: false\n",
+		expectedEnv:  map[string]string{"OTEL_SDK_DISABLED": "false"},
+		expectedUnmapped: []string{
+			"capture_body", "log_level", "transaction_ignore_urls", "transaction_sample_rate",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := TranslateToOTel(tc.settings)
+			b, err := cfg.YAML()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedYAML, string(b))
+			assert.Equal(t, tc.expectedEnv, cfg.Env)
+			assert.Equal(t, tc.expectedUnmapped, cfg.Unmapped)
+		})
+	}
+}
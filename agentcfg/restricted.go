@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import "context"
+
+// RestrictedFetcher serves agent configuration from a Fetcher, restricting
+// the settings served to insecure agents, see Query.InsecureAgents, to a set
+// of unrestricted settings other than UnrestrictedSettings.
+//
+// Fetchers restrict the settings of insecure agents to UnrestrictedSettings
+// on their own, RestrictedFetcher is only needed to serve a different set.
+type RestrictedFetcher struct {
+	fetcher      Fetcher
+	unrestricted map[string]bool
+}
+
+// NewRestrictedFetcher returns a RestrictedFetcher serving the settings
+// identified by unrestricted keys to insecure agents.
+func NewRestrictedFetcher(fetcher Fetcher, unrestricted ...string) *RestrictedFetcher {
+	f := &RestrictedFetcher{
+		fetcher:      fetcher,
+		unrestricted: make(map[string]bool, len(unrestricted)),
+	}
+	for _, k := range unrestricted {
+		f.unrestricted[k] = true
+	}
+	return f
+}
+
+// Fetch fetches the agent config matching query, restricting its settings
+// to the unrestricted ones for insecure agents.
+func (f *RestrictedFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	insecure := query
+	// The wrapped fetcher must not restrict the settings itself.
+	query.InsecureAgents = nil
+	result, err := f.fetcher.Fetch(ctx, query)
+	if err != nil {
+		return Result{}, err
+	}
+	return restrictSettings(insecure, result, f.unrestricted), nil
+}
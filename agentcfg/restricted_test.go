@@ -0,0 +1,51 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestrictedFetcher(t *testing.T) {
+	cfgs := []AgentConfig{{
+		ServiceName: "frontend",
+		AgentName:   "rum-js",
+		Etag:        "1",
+		Config:      map[string]string{"transaction_sample_rate": "0.1", "capture_body": "all", "log_level": "debug"},
+	}}
+	fetcher := NewRestrictedFetcher(newInitializedElasticsearchFetcher(cfgs), "transaction_sample_rate", "log_level")
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "frontend"}, InsecureAgents: []string{"rum-js"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.1", "log_level": "debug"}, result.Source.Settings)
+
+	result, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "frontend"}, InsecureAgents: []string{"js-base"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"transaction_sample_rate": "0.1", "capture_body": "all", "log_level": "debug"}, result.Source.Settings)
+
+	fetcher = NewRestrictedFetcher(newInitializedElasticsearchFetcher(nil))
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "frontend"}})
+	require.NoError(t, err)
+	fetcher = NewRestrictedFetcher(NewElasticsearchFetcher(nil, 0, nil))
+	_, err = fetcher.Fetch(context.Background(), Query{Service: Service{Name: "frontend"}})
+	assert.ErrorIs(t, err, ErrNotReady)
+}
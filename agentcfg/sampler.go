@@ -0,0 +1,215 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// maxPValue is the largest p-value of a sampled span, for a sampling
+// probability of 2^-62. A p-value of 63 denotes a zero adjusted count.
+const maxPValue = 62
+
+// defaultSamplerInterval is the interval at which Sampler fetches the agent
+// config if none is given.
+const defaultSamplerInterval = 30 * time.Second
+
+// Sampler is a sdktrace.Sampler sampling traces with the transaction sample
+// rate of the agent config of a service.
+//
+// Traces are sampled with power of two probabilities, and the p-value of
+// the probability is recorded in the "ot" tracestate entry, so that the
+// adjusted count of sampled spans can be derived from their tracestate.
+// Rates which are not powers of two are approximated by choosing between
+// the two nearest powers of two, so that the expected sampling probability
+// equals the rate.
+//
+// The rate is updated by Run. Sampler only makes decisions for root spans,
+// it is meant to be wrapped with sdktrace.ParentBased.
+type Sampler struct {
+	fetcher     Fetcher
+	logger      *zap.Logger
+	service     Service
+	defaultRate float64
+	interval    time.Duration
+	// rate holds the bits of the current sample rate.
+	rate atomic.Uint64
+}
+
+var _ sdktrace.Sampler = (*Sampler)(nil)
+
+// NewSampler returns a Sampler using the transaction sample rate of the
+// agent config of service, as fetched from fetcher every interval. The
+// defaultRate is used until a rate is fetched, and when the agent config
+// has no transaction sample rate. The agent config is fetched every 30
+// seconds if interval is not positive.
+func NewSampler(
+	fetcher Fetcher,
+	service Service,
+	defaultRate float64,
+	interval time.Duration,
+	logger *zap.Logger,
+) *Sampler {
+	if interval <= 0 {
+		interval = defaultSamplerInterval
+	}
+	s := &Sampler{
+		fetcher:     fetcher,
+		service:     service,
+		defaultRate: defaultRate,
+		interval:    interval,
+		logger:      logger,
+	}
+	s.setRate(defaultRate)
+	return s
+}
+
+// Rate returns the current sample rate.
+func (s *Sampler) Rate() float64 {
+	return math.Float64frombits(s.rate.Load())
+}
+
+func (s *Sampler) setRate(rate float64) {
+	s.rate.Store(math.Float64bits(rate))
+}
+
+// Run updates the sample rate until ctx is done. If the fetcher is a
+// Watcher, the rate is updated whenever the agent config changes, otherwise
+// the agent config is fetched every interval.
+func (s *Sampler) Run(ctx context.Context) error {
+	if watcher, ok := s.fetcher.(Watcher); ok {
+		for result := range watcher.Watch(ctx, s.service) {
+			s.update(result)
+		}
+		return ctx.Err()
+	}
+
+	var etag string
+	fetch := func() {
+		result, err := s.fetcher.Fetch(ctx, Query{Service: s.service, Etag: etag})
+		if err != nil {
+			s.logger.Debug(fmt.Sprintf("failed to fetch agent config for sampler: %s", err))
+			return
+		}
+		s.update(result)
+		etag = result.Source.Etag
+	}
+	fetch()
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			fetch()
+		}
+	}
+}
+
+func (s *Sampler) update(result Result) {
+	rate, ok := result.Float(TransactionSamplingRateKey)
+	if !ok {
+		rate = s.defaultRate
+	}
+	if old := s.Rate(); old != rate {
+		s.logger.Info(fmt.Sprintf("updating transaction sample rate of service %q from %g to %g", s.service.Name, old, rate))
+		s.setRate(rate)
+	}
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s *Sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	ts := trace.SpanContextFromContext(p.ParentContext).TraceState()
+	pValue, ok := samplingPValue(s.Rate(), p.TraceID)
+	if !ok {
+		return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: ts}
+	}
+	// Like sdktrace.TraceIDRatioBased, sample the trace if its low 63 bits
+	// are lower than the sampling probability times 2^63.
+	if binary.BigEndian.Uint64(p.TraceID[8:16])>>1 >= uint64(1)<<(63-pValue) {
+		return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: ts}
+	}
+	if sampled, err := ts.Insert("ot", otTraceStateValue(ts.Get("ot"), pValue)); err == nil {
+		ts = sampled
+	}
+	return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: ts}
+}
+
+// Description implements sdktrace.Sampler.
+func (s *Sampler) Description() string {
+	return fmt.Sprintf("AgentConfigSampler{%s}", s.service.Name)
+}
+
+// samplingPValue returns the p-value of the sampling probability 2^-p used
+// to sample the trace with the given ID. ok is false if the trace must not
+// be sampled.
+//
+// If rate is between the probabilities of two consecutive p-values, the
+// lower p-value is chosen with a probability such that the expected sampling
+// probability equals rate. The choice is derived from the high bits of the
+// trace ID, which are not used for the sampling decision.
+func samplingPValue(rate float64, traceID trace.TraceID) (p uint, ok bool) {
+	switch {
+	case !(rate > 0):
+		return 0, false
+	case rate >= 1:
+		return 0, true
+	}
+	exact := -math.Log2(rate)
+	low := math.Floor(exact)
+	if low >= maxPValue {
+		return maxPValue, true
+	}
+	if exact == low {
+		return uint(low), true
+	}
+	// rate = q*2^-low + (1-q)*2^-(low+1)
+	q := rate*math.Exp2(low+1) - 1
+	u := float64(binary.BigEndian.Uint64(traceID[0:8])>>11) / (1 << 53)
+	if u < q {
+		return uint(low), true
+	}
+	return uint(low) + 1, true
+}
+
+// otTraceStateValue returns the value of the "ot" tracestate entry holding
+// the p-value p, keeping the other sub-keys of the existing value ot.
+func otTraceStateValue(ot string, p uint) string {
+	var b strings.Builder
+	b.WriteString("p:")
+	b.WriteString(strconv.FormatUint(uint64(p), 10))
+	for _, kv := range strings.Split(ot, ";") {
+		if kv != "" && !strings.HasPrefix(kv, "p:") {
+			b.WriteByte(';')
+			b.WriteString(kv)
+		}
+	}
+	return b.String()
+}
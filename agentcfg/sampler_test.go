@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// adjustedCount returns the adjusted count of a span with the tracestate ts,
+// the way the trace enricher computes representative counts.
+func adjustedCount(t testing.TB, ts trace.TraceState) float64 {
+	ot := ts.Get("ot")
+	require.True(t, strings.HasPrefix(ot, "p:"), "missing p-value in %q", ot)
+	p, err := strconv.ParseUint(strings.SplitN(ot[2:], ";", 2)[0], 10, 6)
+	require.NoError(t, err)
+	return math.Pow(2, float64(p))
+}
+
+func TestSamplerAdjustedCount(t *testing.T) {
+	const n = 50000
+	for _, rate := range []float64{1, 0.5, 0.3, 0.125, 0.1} {
+		t.Run(strconv.FormatFloat(rate, 'g', -1, 64), func(t *testing.T) {
+			sampler := NewSampler(nil, Service{Name: "opbeans"}, rate, time.Second, zap.NewNop())
+			rng := rand.New(rand.NewSource(1))
+			var sampled int
+			var count float64
+			for i := 0; i < n; i++ {
+				var traceID trace.TraceID
+				rng.Read(traceID[:])
+				result := sampler.ShouldSample(sdktrace.SamplingParameters{
+					ParentContext: context.Background(),
+					TraceID:       traceID,
+				})
+				if result.Decision == sdktrace.RecordAndSample {
+					sampled++
+					count += adjustedCount(t, result.Tracestate)
+				}
+			}
+			assert.InEpsilon(t, rate*n, sampled, 0.05)
+			assert.InEpsilon(t, n, count, 0.05)
+		})
+	}
+}
+
+func TestSamplerZeroRate(t *testing.T) {
+	sampler := NewSampler(nil, Service{Name: "opbeans"}, 0, time.Second, zap.NewNop())
+	result := sampler.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: context.Background(),
+		TraceID:       trace.TraceID{1},
+	})
+	assert.Equal(t, sdktrace.Drop, result.Decision)
+}
+
+func TestSamplerTraceState(t *testing.T) {
+	ts, err := trace.ParseTraceState("vendor=value,ot=r:5;p:3")
+	require.NoError(t, err)
+	parent := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceState: ts}))
+
+	sampler := NewSampler(nil, Service{Name: "opbeans"}, 1, time.Second, zap.NewNop())
+	result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: parent, TraceID: trace.TraceID{1}})
+	assert.Equal(t, sdktrace.RecordAndSample, result.Decision)
+	assert.Equal(t, "ot=p:0;r:5,vendor=value", result.Tracestate.String())
+}
+
+func TestSamplerRun(t *testing.T) {
+	var mu sync.Mutex
+	var queries []Query
+	settings := Settings{TransactionSamplingRateKey: "0.25"}
+	fetcher := &fetcherMock{fetchFn: func(_ context.Context, query Query) (Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, query)
+		return Result{Source: Source{Settings: settings, Etag: "abc"}}, nil
+	}}
+	sampler := NewSampler(fetcher, Service{Name: "opbeans"}, 1, time.Millisecond, zap.NewNop())
+	assert.Equal(t, 1.0, sampler.Rate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sampler.Run(ctx) }()
+	defer func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	}()
+
+	assert.Eventually(t, func() bool { return sampler.Rate() == 0.25 }, 10*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		// The etag of the applied config is sent with subsequent queries.
+		last := queries[len(queries)-1]
+		return last.Service == Service{Name: "opbeans"} && last.Etag == "abc"
+	}, 10*time.Second, time.Millisecond)
+
+	// The default rate is used when the config has no sample rate.
+	mu.Lock()
+	settings = Settings{}
+	mu.Unlock()
+	assert.Eventually(t, func() bool { return sampler.Rate() == 1 }, 10*time.Second, time.Millisecond)
+}
+
+func TestSamplerRunDefaultInterval(t *testing.T) {
+	fetched := make(chan struct{}, 1)
+	fetcher := &fetcherMock{fetchFn: func(context.Context, Query) (Result, error) {
+		fetched <- struct{}{}
+		return zeroResult(), nil
+	}}
+	sampler := NewSampler(fetcher, Service{Name: "opbeans"}, 1, 0, zap.NewNop())
+	assert.Equal(t, defaultSamplerInterval, sampler.interval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sampler.Run(ctx) }()
+	<-fetched
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestSamplerRunWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeAgentConfigFile(t, dir, "opbeans.yml", `
+- service:
+    name: opbeans
+  settings:
+    transaction_sample_rate: 0.5
+`)
+	fetcher := NewFileFetcher(dir, time.Millisecond, zap.NewNop())
+	sampler := NewSampler(fetcher, Service{Name: "opbeans"}, 1, time.Hour, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fetcher.Run(ctx)
+	done := make(chan error, 1)
+	go func() { done <- sampler.Run(ctx) }()
+
+	assert.Eventually(t, func() bool { return sampler.Rate() == 0.5 }, 10*time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,352 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SettingType is the type of the value of an agent setting.
+type SettingType int
+
+const (
+	// SettingTypeString is a free form string.
+	SettingTypeString SettingType = iota
+	// SettingTypeBool is a boolean, either "true" or "false".
+	SettingTypeBool
+	// SettingTypeInt is an integer.
+	SettingTypeInt
+	// SettingTypeFloat is a floating point number.
+	SettingTypeFloat
+	// SettingTypeDuration is a duration with a unit, e.g. "5ms" or "30s".
+	SettingTypeDuration
+	// SettingTypeBytes is a size with a unit, e.g. "768kb".
+	SettingTypeBytes
+	// SettingTypeEnum is one of a fixed set of strings.
+	SettingTypeEnum
+	// SettingTypeList is a comma separated list of strings.
+	SettingTypeList
+)
+
+// SettingSpec describes a known agent setting.
+type SettingSpec struct {
+	// Min and Max, if set, hold the inclusive bounds of SettingTypeInt and
+	// SettingTypeFloat values. Min also holds the lower bound in milliseconds
+	// of SettingTypeDuration values, which are non-negative if Min is unset.
+	Min *float64
+	Max *float64
+	// Values holds the allowed values of SettingTypeEnum settings.
+	Values []string
+	// Agents holds the prefixes of the agent names the setting applies to.
+	// The setting applies to all agents if Agents is empty.
+	Agents []string
+	Type   SettingType
+}
+
+// SettingSpecs holds the known Elastic agent settings, keyed by name.
+// Settings not found in SettingSpecs are not validated.
+var SettingSpecs = map[string]SettingSpec{
+	TransactionSamplingRateKey:                  {Type: SettingTypeFloat, Min: ptr(0.0), Max: ptr(1.0)},
+	"transaction_max_spans":                     {Type: SettingTypeInt, Min: ptr(0.0), Max: ptr(32000.0)},
+	"stack_trace_limit":                         {Type: SettingTypeInt},
+	"capture_body":                              {Type: SettingTypeEnum, Values: []string{"off", "errors", "transactions", "all"}},
+	"capture_headers":                           {Type: SettingTypeBool},
+	"recording":                                 {Type: SettingTypeBool},
+	"log_level":                                 {Type: SettingTypeEnum, Values: []string{"trace", "debug", "info", "warning", "error", "critical", "off"}},
+	"sanitize_field_names":                      {Type: SettingTypeList},
+	"transaction_ignore_urls":                   {Type: SettingTypeList},
+	"ignore_message_queues":                     {Type: SettingTypeList},
+	"api_request_time":                          {Type: SettingTypeDuration},
+	"api_request_size":                          {Type: SettingTypeBytes},
+	"server_timeout":                            {Type: SettingTypeDuration},
+	"span_frames_min_duration":                  {Type: SettingTypeDuration, Min: ptr(-1.0)},
+	"exit_span_min_duration":                    {Type: SettingTypeDuration},
+	"span_compression_enabled":                  {Type: SettingTypeBool},
+	"span_compression_exact_match_max_duration": {Type: SettingTypeDuration},
+	"span_compression_same_kind_max_duration":   {Type: SettingTypeDuration},
+	"trace_continuation_strategy":               {Type: SettingTypeEnum, Values: []string{"continue", "restart", "restart_external"}},
+	"circuit_breaker_enabled":                   {Type: SettingTypeBool, Agents: []string{"java"}},
+	"enable_log_correlation":                    {Type: SettingTypeBool, Agents: []string{"java"}},
+	"profiling_inferred_spans_enabled":          {Type: SettingTypeBool, Agents: []string{"java"}},
+	"profiling_inferred_spans_min_duration":     {Type: SettingTypeDuration, Agents: []string{"java"}},
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// Validate returns an error if value is not a valid value for the setting.
+func (spec SettingSpec) Validate(value string) error {
+	switch spec.Type {
+	case SettingTypeBool:
+		if _, err := parseBool(value); err != nil {
+			return err
+		}
+	case SettingTypeInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		return spec.validateRange(float64(i))
+	case SettingTypeFloat:
+		f, err := parseFloat(value)
+		if err != nil {
+			return err
+		}
+		return spec.validateRange(f)
+	case SettingTypeDuration:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		minimum := 0.0
+		if spec.Min != nil {
+			minimum = *spec.Min
+		}
+		if float64(d)/float64(time.Millisecond) < minimum {
+			return fmt.Errorf("duration %q is lower than %vms", value, minimum)
+		}
+	case SettingTypeBytes:
+		if _, err := parseBytes(value); err != nil {
+			return err
+		}
+	case SettingTypeEnum:
+		if !slices.Contains(spec.Values, value) {
+			return fmt.Errorf("invalid value %q, expected one of [%s]", value, strings.Join(spec.Values, ", "))
+		}
+	}
+	return nil
+}
+
+func (spec SettingSpec) validateRange(v float64) error {
+	if spec.Min != nil && v < *spec.Min {
+		return fmt.Errorf("value %v is lower than %v", v, *spec.Min)
+	}
+	if spec.Max != nil && v > *spec.Max {
+		return fmt.Errorf("value %v is greater than %v", v, *spec.Max)
+	}
+	return nil
+}
+
+// appliesTo reports whether the setting applies to the agent. Settings of
+// configurations without agent name apply to all agents.
+func (spec SettingSpec) appliesTo(agentName string) bool {
+	return agentName == "" || len(spec.Agents) == 0 || hasAnyPrefix(agentName, spec.Agents)
+}
+
+// ValidateSettings validates the known settings of an agent configuration
+// against SettingSpecs, returning the joined errors of all invalid settings.
+func ValidateSettings(agentName string, settings map[string]string) error {
+	var errs []error
+	for _, key := range sortedKeys(settings) {
+		if err := validateSetting(agentName, key, settings[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateSetting(agentName, key, value string) error {
+	spec, ok := SettingSpecs[key]
+	if !ok {
+		return nil
+	}
+	if !spec.appliesTo(agentName) {
+		return fmt.Errorf("setting %q does not apply to agent %q", key, agentName)
+	}
+	if err := spec.Validate(value); err != nil {
+		return fmt.Errorf("setting %q: %w", key, err)
+	}
+	return nil
+}
+
+// sanitizeAgentConfigs removes invalid settings from cfgs, logging the
+// removed settings. The settings of cfgs are modified in place. Rollouts
+// with a percentage outside of [0, 100] are not rolled out to any instance.
+func sanitizeAgentConfigs(cfgs []AgentConfig, logger *zap.Logger) {
+	for _, cfg := range cfgs {
+		sanitizeSettings(cfg, cfg.Config, logger)
+		if cfg.Rollout == nil {
+			continue
+		}
+		sanitizeSettings(cfg, cfg.Rollout.Baseline, logger)
+		if p := cfg.Rollout.Percentage; !(p >= 0 && p <= 100) {
+			logger.Warn(fmt.Sprintf(
+				"ignoring invalid agent config rollout percentage %g for service %q environment %q",
+				p, cfg.ServiceName, cfg.ServiceEnvironment,
+			))
+			cfg.Rollout.Percentage = 0
+		}
+	}
+}
+
+func sanitizeSettings(cfg AgentConfig, settings map[string]string, logger *zap.Logger) {
+	for _, key := range sortedKeys(settings) {
+		if err := validateSetting(cfg.AgentName, key, settings[key]); err != nil {
+			logger.Warn(fmt.Sprintf(
+				"ignoring invalid agent config setting for service %q environment %q: %s",
+				cfg.ServiceName, cfg.ServiceEnvironment, err,
+			))
+			delete(settings, key)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var durationUnits = []struct {
+	suffix     string
+	multiplier time.Duration
+}{
+	// Suffixes ending with "s" first, so that "s" does not match them.
+	{"us", time.Microsecond},
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+}
+
+// parseDuration parses a duration as used by Elastic agents, which is an
+// integer with one of the us, ms, s, m or h units. Unlike
+// time.ParseDuration, fractions and composite durations such as "1h5m"
+// are invalid.
+func parseDuration(s string) (time.Duration, error) {
+	trimmed := strings.TrimSpace(s)
+	for _, unit := range durationUnits {
+		if n, ok := strings.CutSuffix(trimmed, unit.suffix); ok {
+			v, err := strconv.ParseInt(n, 10, 64)
+			if err != nil || strings.HasPrefix(n, "+") ||
+				v > math.MaxInt64/int64(unit.multiplier) || v < math.MinInt64/int64(unit.multiplier) {
+				break
+			}
+			return time.Duration(v) * unit.multiplier, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid duration %q", s)
+}
+
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longer suffixes first, as "b" is a suffix of all of them.
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"b", 1},
+}
+
+// parseBytes parses a size as used by Elastic agents, which is an integer
+// with one of the b, kb, mb or gb units.
+func parseBytes(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range byteUnits {
+		if n, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			v, err := strconv.ParseInt(n, 10, 64)
+			if err != nil || v < 0 || v > math.MaxInt64/unit.multiplier {
+				break
+			}
+			return v * unit.multiplier, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q", s)
+}
+
+// parseBool parses a boolean, either "true" or "false".
+func parseBool(s string) (bool, error) {
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// parseFloat parses a finite floating point number.
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return f, nil
+}
+
+// Bool returns the value of a boolean setting. ok is false if the setting
+// is not set or is not a valid boolean.
+func (r Result) Bool(key string) (v bool, ok bool) {
+	v, err := parseBool(r.Source.Settings[key])
+	return v, err == nil
+}
+
+// Int returns the value of an integer setting. ok is false if the setting
+// is not set or is not a valid integer.
+func (r Result) Int(key string) (v int64, ok bool) {
+	v, err := strconv.ParseInt(r.Source.Settings[key], 10, 64)
+	return v, err == nil
+}
+
+// Float returns the value of a numeric setting. ok is false if the setting
+// is not set or is not a valid number.
+func (r Result) Float(key string) (v float64, ok bool) {
+	v, err := parseFloat(r.Source.Settings[key])
+	return v, err == nil
+}
+
+// Duration returns the value of a duration setting, e.g. "5ms". ok is
+// false if the setting is not set or is not a valid duration.
+func (r Result) Duration(key string) (v time.Duration, ok bool) {
+	v, err := parseDuration(r.Source.Settings[key])
+	return v, err == nil
+}
+
+// Bytes returns the value of a size setting in bytes, e.g. "768kb". ok is
+// false if the setting is not set or is not a valid size.
+func (r Result) Bytes(key string) (v int64, ok bool) {
+	v, err := parseBytes(r.Source.Settings[key])
+	return v, err == nil
+}
+
+// List returns the value of a comma separated list setting, with spaces
+// around items removed. ok is false if the setting is not set.
+func (r Result) List(key string) (v []string, ok bool) {
+	s, ok := r.Source.Settings[key]
+	if !ok {
+		return nil, false
+	}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			v = append(v, item)
+		}
+	}
+	return v, true
+}
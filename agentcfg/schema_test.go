@@ -0,0 +1,181 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestValidateSettings(t *testing.T) {
+	for _, tc := range []struct {
+		settings    map[string]string
+		name        string
+		agentName   string
+		expectedErr string
+	}{
+		{
+			name: "valid",
+			settings: map[string]string{
+				"transaction_sample_rate":  "0.25",
+				"transaction_max_spans":    "500",
+				"capture_body":             "all",
+				"recording":                "false",
+				"api_request_time":         "10s",
+				"api_request_size":         "768kb",
+				"sanitize_field_names":     "password,secret",
+				"circuit_breaker_enabled":  "true",
+				"unknown_setting":          "anything",
+				"span_frames_min_duration": "-1ms",
+			},
+			agentName: "java",
+		},
+		{
+			name:        "out_of_range",
+			settings:    map[string]string{"transaction_sample_rate": "7"},
+			expectedErr: `setting "transaction_sample_rate": value 7 is greater than 1`,
+		},
+		{
+			name:        "invalid_type",
+			settings:    map[string]string{"transaction_max_spans": "many", "recording": "yes"},
+			expectedErr: "setting \"recording\": invalid boolean \"yes\"\nsetting \"transaction_max_spans\": invalid integer \"many\"",
+		},
+		{
+			name:        "invalid_boolean_spelling",
+			settings:    map[string]string{"recording": "TRUE", "capture_headers": "1"},
+			expectedErr: "setting \"capture_headers\": invalid boolean \"1\"\nsetting \"recording\": invalid boolean \"TRUE\"",
+		},
+		{
+			name:        "non_finite",
+			settings:    map[string]string{"transaction_sample_rate": "NaN"},
+			expectedErr: `setting "transaction_sample_rate": invalid number "NaN"`,
+		},
+		{
+			name:        "invalid_enum",
+			settings:    map[string]string{"capture_body": "some"},
+			expectedErr: `setting "capture_body": invalid value "some", expected one of [off, errors, transactions, all]`,
+		},
+		{
+			name:        "invalid_duration",
+			settings:    map[string]string{"server_timeout": "10 seconds"},
+			expectedErr: `setting "server_timeout": invalid duration "10 seconds"`,
+		},
+		{
+			name:        "negative_duration",
+			settings:    map[string]string{"server_timeout": "-5s", "span_frames_min_duration": "-2ms"},
+			expectedErr: "setting \"server_timeout\": duration \"-5s\" is lower than 0ms\nsetting \"span_frames_min_duration\": duration \"-2ms\" is lower than -1ms",
+		},
+		{
+			name:        "composite_duration",
+			settings:    map[string]string{"server_timeout": "1h5m", "api_request_time": "1.5s"},
+			expectedErr: "setting \"api_request_time\": invalid duration \"1.5s\"\nsetting \"server_timeout\": invalid duration \"1h5m\"",
+		},
+		{
+			name:        "duration_overflow",
+			settings:    map[string]string{"server_timeout": "2562048h"},
+			expectedErr: `setting "server_timeout": invalid duration "2562048h"`,
+		},
+		{
+			name:        "invalid_size",
+			settings:    map[string]string{"api_request_size": "1tb"},
+			expectedErr: `setting "api_request_size": invalid size "1tb"`,
+		},
+		{
+			name:        "size_overflow",
+			settings:    map[string]string{"api_request_size": "8589934592gb"},
+			expectedErr: `setting "api_request_size": invalid size "8589934592gb"`,
+		},
+		{
+			name:        "not_applicable",
+			settings:    map[string]string{"circuit_breaker_enabled": "true"},
+			agentName:   "python",
+			expectedErr: `setting "circuit_breaker_enabled" does not apply to agent "python"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateSettings(tc.agentName, tc.settings)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestResultTypedAccessors(t *testing.T) {
+	result := Result{Source: Source{Settings: Settings{
+		"transaction_sample_rate": "0.5",
+		"transaction_max_spans":   "500",
+		"recording":               "true",
+		"server_timeout":          "5ms",
+		"api_request_size":        "2mb",
+		"sanitize_field_names":    "password, secret,,",
+	}}}
+
+	f, ok := result.Float("transaction_sample_rate")
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, f)
+	i, ok := result.Int("transaction_max_spans")
+	assert.True(t, ok)
+	assert.Equal(t, int64(500), i)
+	b, ok := result.Bool("recording")
+	assert.True(t, ok)
+	assert.True(t, b)
+	d, ok := result.Duration("server_timeout")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Millisecond, d)
+	size, ok := result.Bytes("api_request_size")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2<<20), size)
+	l, ok := result.List("sanitize_field_names")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"password", "secret"}, l)
+
+	_, ok = result.Float("missing")
+	assert.False(t, ok)
+	_, ok = result.Int("transaction_sample_rate")
+	assert.False(t, ok)
+	_, ok = result.List("missing")
+	assert.False(t, ok)
+}
+
+func TestRefreshCacheDropsInvalidSettings(t *testing.T) {
+	hits := []map[string]interface{}{
+		{"_id": "1", "_source": map[string]interface{}{"etag": "1", "service": map[string]interface{}{"name": "first"}, "settings": map[string]interface{}{"transaction_sample_rate": 7, "capture_body": "all", "stack_trace_limit": 50}}},
+	}
+	core, logs := observer.New(zap.WarnLevel)
+	index := newMockAgentConfigIndex(t, hits)
+	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Second, zap.New(core))
+	require.NoError(t, fetcher.refreshCache(context.Background()))
+
+	result, err := fetcher.Fetch(context.Background(), Query{Service: Service{Name: "first"}})
+	require.NoError(t, err)
+	assert.Equal(t, Settings{"capture_body": "all", "stack_trace_limit": "50"}, result.Source.Settings)
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t,
+		`ignoring invalid agent config setting for service "first" environment "": setting "transaction_sample_rate": value 7 is greater than 1`,
+		logs.All()[0].Message,
+	)
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg // import "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// Watcher is implemented by fetchers able to notify about changes of the
+// agent config of a service.
+type Watcher interface {
+	// Watch returns a channel receiving the agent config matching service
+	// whenever it changes. The current agent config, if known, is sent
+	// immediately. Only the latest agent config is kept for slow receivers.
+	// The channel is closed when ctx is done.
+	//
+	// Watches do not identify agents nor agent instances: agent configs
+	// targeting instances are not watched, the baseline of partial rollouts
+	// is, and agent configs without agent name take precedence over agent
+	// specific ones.
+	Watch(ctx context.Context, service Service) <-chan Result
+}
+
+type watch struct {
+	ch      chan Result
+	service Service
+	last    Result
+	sent    bool
+}
+
+// watchers dispatches agent config changes to watches. The zero value is
+// ready to use.
+type watchers struct {
+	watches     map[*watch]struct{}
+	index       agentConfigIndex
+	mu          sync.Mutex
+	initialized bool
+}
+
+func (ws *watchers) watch(ctx context.Context, service Service) <-chan Result {
+	w := &watch{ch: make(chan Result, 1), service: service}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ctx.Err() != nil {
+		close(w.ch)
+		return w.ch
+	}
+	if ws.watches == nil {
+		ws.watches = make(map[*watch]struct{})
+	}
+	ws.watches[w] = struct{}{}
+	if ws.initialized {
+		ws.notify(w)
+	}
+	context.AfterFunc(ctx, func() {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		delete(ws.watches, w)
+		close(w.ch)
+	})
+	return w.ch
+}
+
+// update notifies the watches whose agent config changed in index.
+func (ws *watchers) update(index agentConfigIndex) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.index = index
+	ws.initialized = true
+	for w := range ws.watches {
+		ws.notify(w)
+	}
+}
+
+// notify sends the agent config matching w if it changed since the last
+// notification, replacing any notification not received yet.
+func (ws *watchers) notify(w *watch) {
+	result := ws.index.match(Query{Service: w.service})
+	if w.sent && resultEqual(w.last, result) {
+		return
+	}
+	w.last, w.sent = result, true
+	select {
+	case w.ch <- result:
+	default:
+		select {
+		case <-w.ch:
+		default:
+		}
+		w.ch <- result
+	}
+}
+
+func resultEqual(a, b Result) bool {
+	return a.Source.Etag == b.Source.Etag &&
+		a.Source.Agent == b.Source.Agent &&
+		maps.Equal(a.Source.Settings, b.Source.Settings)
+}
@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var (
+	_ Watcher = (*ElasticsearchFetcher)(nil)
+	_ Watcher = (*FileFetcher)(nil)
+)
+
+func TestWatchers(t *testing.T) {
+	var ws watchers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := ws.watch(ctx, Service{Name: "first", Environment: "production"})
+	assert.Empty(t, ch, "nothing is sent before the first update")
+
+	cfgs := []AgentConfig{
+		{ServiceName: "first", Config: map[string]string{"key": "v1"}, Etag: "1"},
+		{ServiceName: "second", Config: map[string]string{"key": "v1"}, Etag: "2"},
+	}
+	ws.update(newAgentConfigIndex(cfgs))
+	assert.Equal(t, Result{Source: Source{Settings: Settings{"key": "v1"}, Etag: "1"}}, <-ch)
+
+	// Changes to other services are not notified.
+	ws.update(newAgentConfigIndex([]AgentConfig{
+		cfgs[0],
+		{ServiceName: "second", Config: map[string]string{"key": "v2"}, Etag: "3"},
+	}))
+	assert.Empty(t, ch)
+
+	// A more specific config takes precedence.
+	ws.update(newAgentConfigIndex(append(cfgs, AgentConfig{
+		ServiceName:        "first",
+		ServiceEnvironment: "production",
+		Config:             map[string]string{"key": "v2"},
+		Etag:               "4",
+	})))
+	ws.update(agentConfigIndex{})
+	assert.Equal(t, zeroResult(), <-ch, "only the latest config is kept")
+	assert.Empty(t, ch)
+
+	// New watches receive the current config immediately.
+	ch2 := ws.watch(ctx, Service{Name: "other"})
+	assert.Equal(t, zeroResult(), <-ch2)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+	_, ok = <-ch2
+	assert.False(t, ok)
+	assert.Empty(t, ws.watches)
+}
+
+func TestElasticsearchFetcherWatch(t *testing.T) {
+	index := newMockAgentConfigIndex(t, sampleHits[:1])
+	fetcher := NewElasticsearchFetcher(newMockElasticsearchClient(t, index.handle), time.Second, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := fetcher.Watch(ctx, Service{Name: "second"})
+	require.NoError(t, fetcher.refreshCache(ctx))
+	assert.Equal(t, zeroResult(), <-ch)
+
+	index.hits = sampleHits
+	require.NoError(t, fetcher.refreshCache(ctx))
+	result := <-ch
+	assert.Equal(t, "2da2f86251165ccced5c5e41100a216b0c880db4", result.Source.Etag)
+}
@@ -19,6 +19,8 @@ package configelasticsearch
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
 
@@ -80,6 +82,25 @@ func TestConfig(t *testing.T) {
 				cfg.Compression = "gzip"
 			}),
 		},
+		{
+			id:         "api_key",
+			configFile: "config.yaml",
+			expected: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Endpoint = "https://elastic.example.com:9200"
+
+				cfg.APIKey = "Zm9vOmJhcg=="
+			}),
+		},
+		{
+			id:         "basic_auth",
+			configFile: "config.yaml",
+			expected: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Endpoint = "https://elastic.example.com:9200"
+
+				cfg.Username = "elastic"
+				cfg.Password = "changeme"
+			}),
+		},
 	}
 
 	for _, tt := range tests {
@@ -178,6 +199,29 @@ func TestConfig_Validate(t *testing.T) {
 			}),
 			err: `retry::max_requests should be non-negative`,
 		},
+		"api_key and username/password both set": {
+			config: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Endpoints = []string{"http://test:9200"}
+				cfg.APIKey = "Zm9vOmJhcg=="
+				cfg.Username = "elastic"
+				cfg.Password = "changeme"
+			}),
+			err: "at most one of [api_key, username/password, auth] must be specified",
+		},
+		"username without password": {
+			config: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Endpoints = []string{"http://test:9200"}
+				cfg.Username = "elastic"
+			}),
+			err: "username and password must be specified together",
+		},
+		"password without username": {
+			config: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Endpoints = []string{"http://test:9200"}
+				cfg.Password = "changeme"
+			}),
+			err: "username and password must be specified together",
+		},
 	}
 
 	for name, tt := range tests {
@@ -200,6 +244,85 @@ func TestConfig_Validate_Environment(t *testing.T) {
 		err := component.ValidateConfig(config)
 		assert.EqualError(t, err, `invalid endpoint "*:!": parse "*:!": first path segment in URL cannot contain colon`)
 	})
+	t.Run("credentials ignored if configured", func(t *testing.T) {
+		t.Setenv("ELASTICSEARCH_API_KEY", "Zm9vOmJhcg==")
+		config := withDefaultConfig(func(cfg *ClientConfig) {
+			cfg.Endpoints = []string{"http://test:9200"}
+			cfg.Username = "elastic"
+			cfg.Password = "changeme"
+		})
+		err := component.ValidateConfig(config)
+		require.NoError(t, err)
+	})
+	t.Run("invalid credentials", func(t *testing.T) {
+		t.Setenv("ELASTICSEARCH_API_KEY", "Zm9vOmJhcg==")
+		t.Setenv("ELASTICSEARCH_USERNAME", "elastic")
+		t.Setenv("ELASTICSEARCH_PASSWORD", "changeme")
+		config := withDefaultConfig(func(cfg *ClientConfig) {
+			cfg.Endpoints = []string{"http://test:9200"}
+		})
+		err := component.ValidateConfig(config)
+		assert.EqualError(t, err, "at most one of [api_key, username/password, auth] must be specified")
+	})
+}
+
+func TestToClient_Authentication(t *testing.T) {
+	tests := map[string]struct {
+		config   *ClientConfig
+		env      map[string]string
+		expected string
+	}{
+		"none": {
+			config: withDefaultConfig(),
+		},
+		"api_key": {
+			config: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.APIKey = "Zm9vOmJhcg=="
+			}),
+			expected: "ApiKey Zm9vOmJhcg==",
+		},
+		"basic_auth": {
+			config: withDefaultConfig(func(cfg *ClientConfig) {
+				cfg.Username = "elastic"
+				cfg.Password = "changeme"
+			}),
+			expected: "Basic ZWxhc3RpYzpjaGFuZ2VtZQ==",
+		},
+		"api_key environment": {
+			config:   withDefaultConfig(),
+			env:      map[string]string{"ELASTICSEARCH_API_KEY": "Zm9vOmJhcg=="},
+			expected: "ApiKey Zm9vOmJhcg==",
+		},
+		"basic_auth environment": {
+			config:   withDefaultConfig(),
+			env:      map[string]string{"ELASTICSEARCH_USERNAME": "elastic", "ELASTICSEARCH_PASSWORD": "changeme"},
+			expected: "Basic ZWxhc3RpYzpjaGFuZ2VtZQ==",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			authorization := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization <- r.Header.Get("Authorization")
+				w.Header().Set("X-Elastic-Product", "Elasticsearch")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+			tt.config.Endpoint = srv.URL
+
+			client, err := tt.config.ToClient(context.Background(), componenttest.NewNopHost(), componenttest.NewNopTelemetrySettings())
+			require.NoError(t, err)
+			resp, err := client.Info()
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.expected, <-authorization)
+		})
+	}
 }
 
 func withDefaultConfig(fns ...func(*ClientConfig)) *ClientConfig {
@@ -29,13 +29,21 @@ import (
 
 	"go.opentelemetry.io/collector/config/configcompression"
 	"go.opentelemetry.io/collector/config/confighttp"
+	"go.opentelemetry.io/collector/config/configopaque"
 )
 
-const defaultElasticsearchEnvName = "ELASTICSEARCH_URL"
+const (
+	defaultElasticsearchEnvName = "ELASTICSEARCH_URL"
+	apiKeyEnvName               = "ELASTICSEARCH_API_KEY"
+	usernameEnvName             = "ELASTICSEARCH_USERNAME"
+	passwordEnvName             = "ELASTICSEARCH_PASSWORD"
+)
 
 var (
 	errConfigEndpointRequired = errors.New("exactly one of [endpoint, endpoints, cloudid] must be specified")
 	errConfigEmptyEndpoint    = errors.New("endpoint must not be empty")
+	errConfigAuthExclusive    = errors.New("at most one of [api_key, username/password, auth] must be specified")
+	errConfigBasicAuthPartial = errors.New("username and password must be specified together")
 )
 
 // NewDefaultClientConfig returns ClientConfig type object with
@@ -77,6 +85,23 @@ type ClientConfig struct {
 	// ELASTICSEARCH_URL environment variable is not set.
 	Endpoints []string `mapstructure:"endpoints"`
 
+	// APIKey holds the base64 encoded API key used to authenticate requests.
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/http-clients.html
+	//
+	// If none of api_key, username, password and auth are configured, the
+	// ELASTICSEARCH_API_KEY environment variable is used instead, if set.
+	APIKey configopaque.String `mapstructure:"api_key"`
+	// Username and Password hold the credentials used to authenticate
+	// requests with HTTP basic authentication. They must be set together,
+	// and are mutually exclusive with APIKey and the confighttp auth
+	// extension.
+	//
+	// If none of api_key, username, password and auth are configured, the
+	// ELASTICSEARCH_USERNAME and ELASTICSEARCH_PASSWORD environment
+	// variables are used instead, if set.
+	Username string              `mapstructure:"username"`
+	Password configopaque.String `mapstructure:"password"`
+
 	Retry RetrySettings `mapstructure:"retry"`
 
 	Discovery DiscoverySettings `mapstructure:"discover"`
@@ -141,6 +166,10 @@ func (cfg *ClientConfig) Validate() error {
 		return errors.New("compression must be one of [none, gzip]")
 	}
 
+	if _, err := cfg.credentials(); err != nil {
+		return err
+	}
+
 	if cfg.Retry.MaxRetries < 0 {
 		return errors.New("retry::max_requests should be non-negative")
 	}
@@ -201,6 +230,43 @@ func (cfg *ClientConfig) endpoints() ([]string, error) {
 	return endpoints, nil
 }
 
+// credentials holds the credentials used by the Elasticsearch client.
+type credentials struct {
+	apiKey   configopaque.String
+	username string
+	password configopaque.String
+}
+
+func (cfg *ClientConfig) credentials() (credentials, error) {
+	// At most one of api_key, username/password, or the auth extension
+	// may be configured. If none are set, then $ELASTICSEARCH_API_KEY, or
+	// $ELASTICSEARCH_USERNAME and $ELASTICSEARCH_PASSWORD, may be
+	// specified instead.
+	creds := credentials{apiKey: cfg.APIKey, username: cfg.Username, password: cfg.Password}
+	if creds == (credentials{}) && cfg.Auth == nil {
+		creds = credentials{
+			apiKey:   configopaque.String(os.Getenv(apiKeyEnvName)),
+			username: os.Getenv(usernameEnvName),
+			password: configopaque.String(os.Getenv(passwordEnvName)),
+		}
+	}
+
+	basicAuth := creds.username != "" || creds.password != ""
+	if basicAuth && (creds.username == "" || creds.password == "") {
+		return credentials{}, errConfigBasicAuthPartial
+	}
+	var numAuthConfigs int
+	for _, configured := range []bool{creds.apiKey != "", basicAuth, cfg.Auth != nil} {
+		if configured {
+			numAuthConfigs++
+		}
+	}
+	if numAuthConfigs > 1 {
+		return credentials{}, errConfigAuthExclusive
+	}
+	return creds, nil
+}
+
 // Based on "addrFromCloudID" in go-elasticsearch.
 func parseCloudID(input string) (*url.URL, error) {
 	_, after, ok := strings.Cut(input, ":")
@@ -117,6 +117,14 @@ func (cfg *ClientConfig) ToClient(
 		return nil, err
 	}
 
+	// credentials converts Config.APIKey, Config.Username and
+	// Config.Password, or their environment variables, to client
+	// credentials.
+	creds, err := cfg.credentials()
+	if err != nil {
+		return nil, err
+	}
+
 	esLogger := clientLogger{
 		Logger:          telemetry.Logger,
 		logRequestBody:  cfg.TelemetrySettings.LogRequestBody,
@@ -134,6 +142,11 @@ func (cfg *ClientConfig) ToClient(
 		// configure connection setup
 		Addresses: endpoints,
 
+		// configure authentication
+		APIKey:   string(creds.apiKey),
+		Username: creds.username,
+		Password: string(creds.password),
+
 		// configure retry behavior
 		RetryOnStatus: cfg.Retry.RetryOnStatus,
 		DisableRetry:  !cfg.Retry.Enabled,